@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// archiveFormats are the supported values of archive.
+var archiveFormats = map[string]func(io.Writer, []string) error{
+	"tar.gz": writeTarGz,
+	"zip":    writeZip,
+}
+
+// createArchive bundles files into a new archive of the given format at
+// path. Each file is stored under its base name, and directories are
+// stored along with their contents.
+func createArchive(format string, path string, files []string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := archiveFormats[format](f, files); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	return f.Close()
+}
+
+// walkArchiveEntries calls fn for each file and directory to be archived,
+// along with the name it is stored under.
+func walkArchiveEntries(files []string, fn func(path string, name string, info os.FileInfo) error) error {
+	for _, file := range files {
+		base := filepath.Dir(file)
+		err := filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			name, err := filepath.Rel(base, path)
+			if err != nil {
+				return err
+			}
+			return fn(path, filepath.ToSlash(name), info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeTarGz(w io.Writer, files []string) error {
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	err := walkArchiveEntries(files, func(path string, name string, info os.FileInfo) error {
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFileTo(tw, path)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+func writeZip(w io.Writer, files []string) error {
+	zw := zip.NewWriter(w)
+
+	err := walkArchiveEntries(files, func(path string, name string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFileTo(entry, path)
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// copyFileTo copies the contents of the file at path to w.
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -1,20 +1,31 @@
 package main
 
-import "github.com/mitchellh/packer/packer"
+import (
+	"os"
+
+	"github.com/mitchellh/packer/packer"
+)
 
 type Artifact struct {
 	builderId string
-	files []string
-	id string
-	str string
+	files     []string
+	id        string
+	str       string
+	state     map[string]interface{}
+
+	// Files generated by the post-processor, such as checksum sidecars,
+	// archives and copies of the artifact's files, that are removed when
+	// the artifact is destroyed.
+	aux []string
 }
 
 func NewArtifact(artifact packer.Artifact) *Artifact {
 	return &Artifact{
-		builderId:     artifact.BuilderId(),
+		builderId: artifact.BuilderId(),
 		files:     artifact.Files(),
-		id:     artifact.Id(),
-		str:     artifact.String(),
+		id:        artifact.Id(),
+		str:       artifact.String(),
+		state:     make(map[string]interface{}),
 	}
 }
 
@@ -31,13 +42,28 @@ func (a *Artifact) Id() string {
 }
 
 func (a *Artifact) String() string {
-	return a.str;
+	return a.str
 }
 
+// State returns the named state value. The exit code of the last script
+// run is available as the int "exit_code". Composite artifacts list the
+// files for each provider as the map[string][]string "provider_files".
 func (a *Artifact) State(name string) interface{} {
-	return nil
+	return a.state[name]
 }
 
+// Destroy removes the files generated by the post-processor. The input
+// artifact's files are left to the artifact they came from.
 func (a *Artifact) Destroy() error {
+	errs := new(packer.MultiError)
+	for _, path := range a.aux {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
 	return nil
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+func TestArtifact_ImplementsArtifact(t *testing.T) {
+	var _ packer.Artifact = new(Artifact)
+}
+
+func TestNewArtifact(t *testing.T) {
+	in := testArtifact("a.img", "b.img")
+	in.state["key"] = "value"
+
+	out := NewArtifact(in)
+	if out.BuilderId() != in.BuilderId() {
+		t.Errorf("expected builder ID %s, got %s", in.BuilderId(), out.BuilderId())
+	}
+	if out.Id() != in.Id() {
+		t.Errorf("expected ID %s, got %s", in.Id(), out.Id())
+	}
+	if out.String() != in.String() {
+		t.Errorf("expected string %q, got %q", in.String(), out.String())
+	}
+	if !reflect.DeepEqual(out.Files(), in.Files()) {
+		t.Errorf("expected files %v, got %v", in.Files(), out.Files())
+	}
+	if out.State("key") != nil {
+		t.Error("expected state not to be copied unless asked for")
+	}
+}
+
+func TestArtifact_Destroy(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "image.sha256", "")
+	busy := filepath.Join(dir, "busy")
+	writeFile(t, busy, "file", "")
+
+	a := testArtifact()
+	a.aux = []string{file, filepath.Join(dir, "missing"), busy}
+	err := a.Destroy()
+	if err == nil || !strings.Contains(err.Error(), busy) {
+		t.Fatalf("expected an error removing %s, got %v", busy, err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed despite the error", file)
+	}
+
+	a.aux = []string{filepath.Join(dir, "missing")}
+	if err := a.Destroy(); err != nil {
+		t.Errorf("expected files that are already gone to be ignored, got %s", err)
+	}
+}
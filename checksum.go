@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checksumTypes maps the supported compute_checksum values to their hash
+// constructors.
+var checksumTypes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// checksumFile returns the hex encoded digest of the file at path using
+// the named algorithm.
+func checksumFile(algo string, path string) (string, error) {
+	newHash, ok := checksumTypes[algo]
+	if !ok {
+		return "", fmt.Errorf("unsupported checksum type: %s", algo)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := newHash()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeChecksumSidecar writes sum to "<path>.<algo>" in the format used by
+// the sha256sum family of tools and returns the sidecar's path.
+func writeChecksumSidecar(algo string, path string, sum string) (string, error) {
+	sidecar := path + "." + algo
+	contents := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+	if err := ioutil.WriteFile(sidecar, []byte(contents), 0644); err != nil {
+		return "", err
+	}
+	return sidecar, nil
+}
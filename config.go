@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// redacted replaces the values of options that may hold secrets in the
+// config exported to scripts.
+const redacted = "REDACTED"
+
+// sensitiveOptions are the options whose values are redacted in full,
+// since the commands they hold may embed credentials.
+var sensitiveOptions = map[string]bool{
+	"idempotency_check": true,
+	"inline":            true,
+	"inline_base64":     true,
+	"inline_scripts":    true,
+	"precheck_command":  true,
+	"sudo_command":      true,
+}
+
+// effectiveConfig returns the post-processor's options, keyed by their
+// names in the template, as JSON for PACKER_SHELL_CONFIG. The values of
+// environment_vars, script_environments and sensitiveOptions are
+// redacted.
+func effectiveConfig(c *Config) (string, error) {
+	options := make(map[string]interface{})
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if field.PkgPath != "" || name == "" || name == "-" {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		switch {
+		case name == "environment_vars":
+			vars := make([]string, len(c.Vars))
+			for j, kv := range c.Vars {
+				vars[j] = strings.SplitN(kv, "=", 2)[0] + "=" + redacted
+			}
+			value = vars
+		case name == "script_environments":
+			envs := make(map[string][]string, len(c.ScriptEnvironments))
+			for path, vars := range c.ScriptEnvironments {
+				keys := make([]string, 0, len(vars))
+				for key := range vars {
+					keys = append(keys, key+"="+redacted)
+				}
+				sort.Strings(keys)
+				envs[path] = keys
+			}
+			value = envs
+		case sensitiveOptions[name] && !v.Field(i).IsZero():
+			value = redacted
+		}
+		options[name] = value
+	}
+
+	contents, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	return string(contents), nil
+}
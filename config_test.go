@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEffectiveConfig(t *testing.T) {
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":            []string{"curl -u admin:hunter2 https://example.com"},
+		"environment_vars":  []string{"TOKEN=hunter2", "REGION=us-east-1"},
+		"precheck_command":  "check --password hunter2",
+		"retries":           2,
+		"show_progress":     false,
+		"inline_extension":  ".sh",
+		"idempotency_check": "test -f done",
+	})
+
+	encoded, err := effectiveConfig(&p.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(encoded, "hunter2") {
+		t.Fatalf("expected secrets to be redacted, got %s", encoded)
+	}
+
+	var options map[string]interface{}
+	if err := json.Unmarshal([]byte(encoded), &options); err != nil {
+		t.Fatalf("expected JSON: %s", err)
+	}
+	for name, want := range map[string]interface{}{
+		"inline":            redacted,
+		"environment_vars":  []interface{}{"TOKEN=" + redacted, "REGION=" + redacted},
+		"precheck_command":  redacted,
+		"idempotency_check": redacted,
+		"retries":           float64(2),
+		"show_progress":     false,
+		"inline_extension":  ".sh",
+		"inline_shebang":    "/bin/sh",
+	} {
+		if got := options[name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %s to be %#v, got %#v", name, want, got)
+		}
+	}
+	if _, ok := options["packer_build_name"]; ok {
+		t.Error("expected the squashed packer options to be left out")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// diffContext is the number of unchanged lines shown around a change.
+const diffContext = 3
+
+// maxDiffCells bounds the size of the table used to find the longest
+// common subsequence of the changed lines. Larger changes are shown as a
+// removal of every old line followed by an addition of every new one.
+const maxDiffCells = 1 << 20
+
+// isText reports whether contents looks like text rather than binary data.
+func isText(contents []byte) bool {
+	return utf8.Valid(contents) && bytes.IndexByte(contents, 0) == -1
+}
+
+// unifiedDiff returns a unified diff, with a single hunk covering every
+// change, between the before and after contents of the named file. It
+// returns an empty string when the contents are the same.
+func unifiedDiff(name string, before, after []byte) string {
+	a := splitLines(before)
+	b := splitLines(after)
+
+	// Skip the lines the two versions have in common at either end.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	if prefix == len(a) && prefix == len(b) {
+		return ""
+	}
+
+	aEnd := len(a) - suffix
+	bEnd := len(b) - suffix
+	start := prefix - diffContext
+	if start < 0 {
+		start = 0
+	}
+	trailing := suffix
+	if trailing > diffContext {
+		trailing = diffContext
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--- %s (before)\n+++ %s (after)\n", name, name)
+	fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n",
+		start+1, aEnd+trailing-start, start+1, bEnd+trailing-start)
+	for _, line := range a[start:prefix] {
+		buf.WriteString(" " + line + "\n")
+	}
+	for _, line := range diffLines(a[prefix:aEnd], b[prefix:bEnd]) {
+		buf.WriteString(line + "\n")
+	}
+	for _, line := range a[aEnd : aEnd+trailing] {
+		buf.WriteString(" " + line + "\n")
+	}
+
+	return buf.String()
+}
+
+// diffLines returns the lines of a and b prefixed with " ", "-" or "+"
+// depending on whether they are common to both, only in a or only in b.
+func diffLines(a, b []string) []string {
+	result := make([]string, 0, len(a)+len(b))
+	if len(a)*len(b) > maxDiffCells {
+		for _, line := range a {
+			result = append(result, "-"+line)
+		}
+		for _, line := range b {
+			result = append(result, "+"+line)
+		}
+		return result
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			result = append(result, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			result = append(result, "-"+a[i])
+			i++
+		default:
+			result = append(result, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		result = append(result, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		result = append(result, "+"+b[j])
+	}
+
+	return result
+}
+
+// splitLines splits contents into lines without their line endings.
+func splitLines(contents []byte) []string {
+	s := strings.TrimSuffix(string(contents), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{"unchanged", "a\nb\n", "a\nb\n", ""},
+		{
+			"changed line",
+			"1\n2\n3\n4\n5\n6\n7\n8\n",
+			"1\n2\n3\n4\nfive\n6\n7\n8\n",
+			"--- f (before)\n+++ f (after)\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			"added line",
+			"a\n",
+			"a\nb\n",
+			"--- f (before)\n+++ f (after)\n@@ -1,1 +1,2 @@\n a\n+b\n",
+		},
+	} {
+		if got := unifiedDiff("f", []byte(tc.before), []byte(tc.after)); got != tc.want {
+			t.Errorf("%s: expected diff:\n%s\ngot:\n%s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestIsText(t *testing.T) {
+	if !isText([]byte("plain text\n")) {
+		t.Error("expected text to be text")
+	}
+	if isText([]byte{'a', 0, 'b'}) {
+		t.Error("expected a NUL byte to mark the contents as binary")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The sources of the environment variables passed to scripts, as named in
+// env_precedence.
+const (
+	envInherited = "inherited"
+	envPacker    = "packer"
+	envUser      = "user"
+)
+
+// The names of the environment variables set by the post-processor.
+const (
+	envBuildName          = "PACKER_BUILD_NAME"
+	envBuilderType        = "PACKER_BUILDER_TYPE"
+	envWorkingDir         = "PACKER_WORKING_DIR"
+	envShell              = "PACKER_SHELL"
+	envTotalArtifactFiles = "PACKER_TOTAL_ARTIFACT_FILES"
+	envVarsFile           = "PACKER_VARS_FILE"
+	envArtifactChecksum   = "PACKER_ARTIFACT_CHECKSUM"
+	envBuildTimestamp     = "PACKER_BUILD_TIMESTAMP"
+	envArtifactFd         = "PACKER_ARTIFACT_FD"
+	envRunSeq             = "PACKER_RUN_SEQ"
+	envShellConfig        = "PACKER_SHELL_CONFIG"
+	envArtifactFileCount  = "PACKER_ARTIFACT_FILE_COUNT"
+	envArtifactFileIndex  = "PACKER_ARTIFACT_FILE_INDEX"
+	envArtifactFiles      = "PACKER_ARTIFACT_FILES"
+	envOutputManifest     = "PACKER_OUTPUT_MANIFEST"
+)
+
+// RequiredEnvSchema returns the names of the environment variables the
+// post-processor may set for scripts, for documentation and tooling. Some
+// are only set when the options enabling them are.
+func RequiredEnvSchema() []string {
+	return []string{
+		envBuildName,
+		envBuilderType,
+		envWorkingDir,
+		envShell,
+		envTotalArtifactFiles,
+		envVarsFile,
+		envArtifactChecksum,
+		envBuildTimestamp,
+		envArtifactFd,
+		envRunSeq,
+		envShellConfig,
+		envArtifactFileCount,
+		envArtifactFileIndex,
+		envArtifactFiles,
+		envOutputManifest,
+	}
+}
+
+// defaultEnvPrecedence is used when env_precedence isn't set. The host
+// environment isn't passed to scripts and Packer's variables win over the
+// user's.
+var defaultEnvPrecedence = []string{envUser, envPacker}
+
+// environment holds the variables passed to a script, by source. Each
+// slice holds "key=value" entries.
+type environment struct {
+	packer []string
+	user   []string
+}
+
+// with returns a copy of e with the given variables added to those set by
+// Packer.
+func (e environment) with(vars ...string) environment {
+	packer := make([]string, 0, len(e.packer)+len(vars))
+	packer = append(packer, e.packer...)
+	packer = append(packer, vars...)
+	return environment{packer: packer, user: e.user}
+}
+
+// withUser returns a copy of e with the given variables added to the
+// user's.
+func (e environment) withUser(vars ...string) environment {
+	user := make([]string, 0, len(e.user)+len(vars))
+	user = append(user, e.user...)
+	user = append(user, vars...)
+	return environment{packer: e.packer, user: user}
+}
+
+// containsString returns whether s is one of list.
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// validateEnvPrecedence checks that precedence names each of the sources
+// at most once, and includes both the Packer and user ones.
+func validateEnvPrecedence(precedence []string) error {
+	seen := make(map[string]bool)
+	for _, source := range precedence {
+		switch source {
+		case envInherited, envPacker, envUser:
+		default:
+			return fmt.Errorf("unknown source '%s', must be one of %s, %s or %s",
+				source, envInherited, envPacker, envUser)
+		}
+		if seen[source] {
+			return fmt.Errorf("source '%s' listed more than once", source)
+		}
+		seen[source] = true
+	}
+
+	for _, source := range []string{envPacker, envUser} {
+		if !seen[source] {
+			return fmt.Errorf("source '%s' must be listed", source)
+		}
+	}
+	return nil
+}
+
+// merge returns the variables of e merged according to precedence, which
+// lists the sources from lowest to highest precedence. When a key is set
+// by several sources, the value from the source with the highest
+// precedence is used. With upperKeys, keys are upper cased first, so ones
+// differing only in case are treated as the same.
+func (e environment) merge(precedence []string, upperKeys bool) []string {
+	values := make(map[string]string)
+	keys := make([]string, 0)
+	for _, source := range precedence {
+		var vars []string
+		switch source {
+		case envInherited:
+			vars = os.Environ()
+		case envPacker:
+			vars = e.packer
+		case envUser:
+			vars = e.user
+		}
+
+		for _, kv := range vars {
+			vs := strings.SplitN(kv, "=", 2)
+			if len(vs) != 2 {
+				continue
+			}
+			key := vs[0]
+			if upperKeys {
+				key = strings.ToUpper(key)
+			}
+			if _, ok := values[key]; !ok {
+				keys = append(keys, key)
+			}
+			values[key] = vs[1]
+		}
+	}
+
+	merged := make([]string, len(keys))
+	for i, key := range keys {
+		merged[i] = key + "=" + values[key]
+	}
+	return merged
+}
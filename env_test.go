@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// lookupEnv returns the value of key in vars, which holds "key=value"
+// entries, and whether it is set.
+func lookupEnv(vars []string, key string) (string, bool) {
+	for _, kv := range vars {
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+func TestEnvironmentMerge_Precedence(t *testing.T) {
+	t.Setenv("CONFLICT", "inherited")
+	e := environment{
+		packer: []string{"CONFLICT=packer"},
+		user:   []string{"CONFLICT=user"},
+	}
+
+	for _, tc := range []struct {
+		precedence []string
+		want       string
+	}{
+		{[]string{envUser, envPacker}, "packer"},
+		{[]string{envPacker, envUser}, "user"},
+		{[]string{envInherited, envUser, envPacker}, "packer"},
+		{[]string{envPacker, envUser, envInherited}, "inherited"},
+		{[]string{envUser, envInherited, envPacker}, "packer"},
+	} {
+		merged := e.merge(tc.precedence, false)
+		if got, _ := lookupEnv(merged, "CONFLICT"); got != tc.want {
+			t.Errorf("%v: expected CONFLICT=%s, got %s", tc.precedence, tc.want, got)
+		}
+
+		var count int
+		for _, kv := range merged {
+			if strings.HasPrefix(kv, "CONFLICT=") {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("%v: expected CONFLICT once, got it %d times", tc.precedence, count)
+		}
+	}
+}
+
+func TestEnvironmentMerge_WithoutInherited(t *testing.T) {
+	t.Setenv("ONLY_ON_HOST", "1")
+	merged := environment{packer: []string{"A=1"}}.merge(defaultEnvPrecedence, false)
+	if _, ok := lookupEnv(merged, "ONLY_ON_HOST"); ok {
+		t.Fatalf("expected the host environment not to be passed, got %v", merged)
+	}
+}
+
+func TestValidateEnvPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		precedence []string
+		valid      bool
+	}{
+		{[]string{envUser, envPacker}, true},
+		{[]string{envInherited, envPacker, envUser}, true},
+		{[]string{envUser}, false},
+		{[]string{envUser, envPacker, envUser}, false},
+		{[]string{envUser, envPacker, "system"}, false},
+	} {
+		err := validateEnvPrecedence(tc.precedence)
+		if tc.valid != (err == nil) {
+			t.Errorf("%v: expected valid %t, got error %v", tc.precedence, tc.valid, err)
+		}
+	}
+}
+
+func TestRequiredEnvSchema(t *testing.T) {
+	schema := RequiredEnvSchema()
+	seen := make(map[string]bool)
+	for _, name := range schema {
+		if !strings.HasPrefix(name, "PACKER_") {
+			t.Errorf("expected %s to start with PACKER_", name)
+		}
+		if seen[name] {
+			t.Errorf("%s is listed more than once", name)
+		}
+		seen[name] = true
+	}
+
+	for _, name := range []string{
+		"PACKER_BUILD_NAME",
+		"PACKER_BUILDER_TYPE",
+		"PACKER_WORKING_DIR",
+		"PACKER_SHELL",
+		"PACKER_TOTAL_ARTIFACT_FILES",
+		"PACKER_BUILD_TIMESTAMP",
+	} {
+		if !seen[name] {
+			t.Errorf("expected %s in the schema, got %v", name, schema)
+		}
+	}
+}
+
+func TestEnvironmentMerge_UpperKeys(t *testing.T) {
+	e := environment{
+		packer: []string{"PACKER_BUILD_NAME=build"},
+		user:   []string{"Region=us-east-1", "region=us-west-2", "Zone=a"},
+	}
+
+	for _, tc := range []struct {
+		upperKeys bool
+		want      []string
+	}{
+		{false, []string{"Region=us-east-1", "region=us-west-2", "Zone=a", "PACKER_BUILD_NAME=build"}},
+		{true, []string{"REGION=us-west-2", "ZONE=a", "PACKER_BUILD_NAME=build"}},
+	} {
+		merged := e.merge(defaultEnvPrecedence, tc.upperKeys)
+		if strings.Join(merged, " ") != strings.Join(tc.want, " ") {
+			t.Errorf("upperKeys %t: expected %v, got %v", tc.upperKeys, tc.want, merged)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"syscall"
+)
+
+// ScriptError is returned when a script fails. It records which script
+// failed against which artifact file, and how.
+type ScriptError struct {
+	// The script that failed, as configured.
+	Script string
+
+	// The artifact file the script was run against. Empty when the script
+	// was run without one.
+	File string
+
+	// The script's exit code, or -1 when it didn't exit normally.
+	ExitCode int
+
+	// The signal that killed the script, such as "segmentation fault".
+	// Empty when it wasn't killed by one.
+	Signal string
+
+	// What the script wrote to stderr.
+	Stderr string
+
+	// The underlying error from running the script.
+	Err error
+}
+
+func (e *ScriptError) Error() string {
+	target := ""
+	if e.File != "" {
+		target = fmt.Sprintf(" with artifact %s", e.File)
+	}
+	status := fmt.Sprintf("exit code %d", e.ExitCode)
+	if e.Signal != "" {
+		status = fmt.Sprintf("killed by signal: %s", e.Signal)
+	}
+	return fmt.Sprintf("Script %s failed%s (%s): %s\n%s",
+		e.Script, target, status, e.Err, e.Stderr)
+}
+
+// exitSignal returns the name of the signal that killed the process err
+// is from, or "" when it wasn't killed by one.
+func exitSignal(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return status.Signal().String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestScriptError_Error(t *testing.T) {
+	for _, tc := range []struct {
+		err  *ScriptError
+		want string
+	}{
+		{
+			&ScriptError{Script: "a.sh", File: "disk.img", ExitCode: 3, Stderr: "oops\n", Err: errors.New("exit status 3")},
+			"Script a.sh failed with artifact disk.img (exit code 3): exit status 3\noops\n",
+		},
+		{
+			&ScriptError{Script: "a.sh", ExitCode: 1, Err: errors.New("exit status 1")},
+			"Script a.sh failed (exit code 1): exit status 1\n",
+		},
+		{
+			&ScriptError{Script: "a.sh", ExitCode: -1, Signal: "segmentation fault", Err: errors.New("signal: segmentation fault")},
+			"Script a.sh failed (killed by signal: segmentation fault): signal: segmentation fault\n",
+		},
+	} {
+		if got := tc.err.Error(); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// stderrWatcher passes writes through to w, killing cmd, and the rest of
+// its process group, as soon as the first byte is written. Children left
+// running would otherwise keep stderr open, and the script from finishing.
+type stderrWatcher struct {
+	w   io.Writer
+	cmd *exec.Cmd
+
+	once      sync.Once
+	triggered bool
+}
+
+func (s *stderrWatcher) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		s.once.Do(func() {
+			s.triggered = true
+			terminateProcessGroup(s.cmd.Process, os.Kill)
+		})
+	}
+	return s.w.Write(p)
+}
+
+// limitedBuffer is a bytes.Buffer that discards what is written past its
+// first limit bytes, unless limit is 0, and records that it did. Writes
+// always succeed so that the writer isn't disturbed, and may come from
+// several goroutines, such as when stdout and stderr are captured
+// together but copied separately.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int64
+	truncated bool
+
+	mu sync.Mutex
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 {
+		if room := b.limit - int64(b.Len()); room < int64(len(p)) {
+			b.truncated = true
+			if room > 0 {
+				b.Buffer.Write(p[:room])
+			}
+			return len(p), nil
+		}
+	}
+	return b.Buffer.Write(p)
+}
+
+// WriteString and ReadFrom hide bytes.Buffer's, which io.Copy, and so
+// exec.Cmd, would otherwise use to write past the limit.
+func (b *limitedBuffer) WriteString(s string) (int, error) {
+	return b.Write([]byte(s))
+}
+
+func (b *limitedBuffer) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(struct{ io.Writer }{b}, r)
+}
+
+func (b *limitedBuffer) Reset() {
+	b.Buffer.Reset()
+	b.truncated = false
+}
+
+// String returns the contents of the buffer, noting when they were
+// truncated.
+func (b *limitedBuffer) String() string {
+	if b.truncated {
+		return b.Buffer.String() + "\n(output truncated)\n"
+	}
+	return b.Buffer.String()
+}
+
+// tailLines returns the last n lines of s, or all of s when n is 0.
+func tailLines(s string, n int) string {
+	if n <= 0 {
+		return s
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(s, "\n"), "\n")
+	if len(lines) <= n {
+		return s
+	}
+	return strings.Join(lines[len(lines)-n:], "") + "\n"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLimitedBuffer(t *testing.T) {
+	for _, tc := range []struct {
+		limit     int64
+		writes    []string
+		want      string
+		truncated bool
+	}{
+		{0, []string{"abc", "def"}, "abcdef", false},
+		{6, []string{"abc", "def"}, "abcdef", false},
+		{4, []string{"abc", "def"}, "abcd", true},
+		{3, []string{"abc", "def", "ghi"}, "abc", true},
+		{2, []string{"abcdef"}, "ab", true},
+	} {
+		b := limitedBuffer{limit: tc.limit}
+		for _, w := range tc.writes {
+			if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+				t.Errorf("limit %d: expected the write of %q to succeed, got %d, %v", tc.limit, w, n, err)
+			}
+		}
+		if got := b.Buffer.String(); got != tc.want {
+			t.Errorf("limit %d: expected %q, got %q", tc.limit, tc.want, got)
+		}
+		if b.truncated != tc.truncated {
+			t.Errorf("limit %d: expected truncated %t, got %t", tc.limit, tc.truncated, b.truncated)
+		}
+		if got := strings.HasSuffix(b.String(), "(output truncated)\n"); got != tc.truncated {
+			t.Errorf("limit %d: expected the truncation to be noted: %t, got %q", tc.limit, tc.truncated, b.String())
+		}
+
+		b.Reset()
+		if b.Len() != 0 || b.truncated {
+			t.Errorf("limit %d: expected Reset to clear the buffer", tc.limit)
+		}
+	}
+}
+
+func TestLimitedBuffer_Copy(t *testing.T) {
+	// exec.Cmd copies output with io.Copy, which prefers the reader's
+	// WriteTo and then the writer's ReadFrom over Write.
+	for _, r := range []io.Reader{
+		strings.NewReader("abcdef"),
+		struct{ io.Reader }{strings.NewReader("abcdef")},
+	} {
+		b := limitedBuffer{limit: 3}
+		if _, err := io.Copy(&b, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := b.Buffer.String(); got != "abc" || !b.truncated {
+			t.Errorf("%T: expected io.Copy to be limited to %q, got %q", r, "abc", got)
+		}
+	}
+}
+
+func TestLimitedBuffer_ConcurrentWrites(t *testing.T) {
+	// With capture_combined, stdout and stderr are copied into the same
+	// buffer from separate goroutines.
+	b := limitedBuffer{limit: 1000}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				b.Write([]byte("abc"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := b.Len(); got != 1000 || !b.truncated {
+		t.Fatalf("expected 1000 bytes and truncation, got %d bytes", got)
+	}
+}
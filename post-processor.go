@@ -3,13 +3,29 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mitchellh/packer/common"
 	"github.com/mitchellh/packer/helper/config"
@@ -24,26 +40,387 @@ type Config struct {
 	// in the context of a single shell.
 	Inline []string `mapstructure:"inline"`
 
+	// An inline script given as a single base64 encoded string, for
+	// machine-generated templates. It is run in the same way as inline.
+	InlineBase64 string `mapstructure:"inline_base64"`
+
+	// Named inline scripts, keyed by filename. Each is run, in order of
+	// name, in the same way as the inline block.
+	InlineScripts map[string]string `mapstructure:"inline_scripts"`
+
 	// The shebang value used when running inline scripts.
 	InlineShebang string `mapstructure:"inline_shebang"`
 
+	// Additional arguments passed to the inline_shebang interpreter.
+	InlineShebangArgs []string `mapstructure:"inline_shebang_args"`
+
+	// The separator written after each inline command. Defaults to "\n".
+	InlineSeparator string `mapstructure:"inline_separator"`
+
+	// Commands, such as "set -e", written to inline scripts right after
+	// the shebang line.
+	InlinePrologue string `mapstructure:"inline_prologue"`
+
+	// The filename extension given to the generated inline script, for
+	// interpreters that require one.
+	InlineExtension string `mapstructure:"inline_extension"`
+
 	// The local path of the shell script to upload and execute.
 	Script string `mapstructure:"script"`
 
+	// Skip scripts that don't exist, with a warning, instead of failing.
+	SkipMissingScripts bool `mapstructure:"skip_missing_scripts"`
+
+	// Extra arguments passed to every script after the artifact file.
+	ScriptArgs []string `mapstructure:"script_args"`
+
 	// An array of environment variables that will be injected before
-	// your command(s) are executed.
+	// your command(s) are executed. config.Decode interpolates them with
+	// the template's user variables, so {{user "name"}} can be used.
 	Vars []string `mapstructure:"environment_vars"`
 
+	// The sources of the scripts' environment variables, from lowest to
+	// highest precedence: "inherited" (the host environment), "packer"
+	// (the PACKER_* variables) and "user" (environment_vars).
+	EnvPrecedence []string `mapstructure:"env_precedence"`
+
+	// Expand references to the host's environment variables, such as
+	// $PATH, in the values of environment_vars.
+	ExpandHostEnv bool `mapstructure:"expand_host_env"`
+
+	// Pass the host's environment to the scripts, below everything else
+	// in precedence. Shorthand for adding "inherited" to the start of
+	// env_precedence.
+	InheritEnvironment bool `mapstructure:"inherit_environment"`
+
+	// Whether the scripts start from an empty environment. Setting it to
+	// false is the same as setting inherit_environment.
+	ClearEnv *bool `mapstructure:"clear_env"`
+
+	// The PATH given to the scripts when the host environment isn't
+	// passed to them and environment_vars doesn't set one.
+	MinimalPath string `mapstructure:"minimal_path"`
+
+	// How the keys of the scripts' environment variables are cased:
+	// "preserve" passes them as given, while "upper" upper cases them, so
+	// keys differing only in case are treated as the same variable.
+	NormalizeEnvCase string `mapstructure:"normalize_env_case"`
+
+	// Let PACKER_BUILD_NAME and PACKER_BUILDER_TYPE given in
+	// environment_vars replace the values set by Packer.
+	OverridePackerVars bool `mapstructure:"override_packer_vars"`
+
+	// A file of additional environment variables, one 'key=value' per
+	// line. The contents are interpolated before being parsed.
+	VarsFile string `mapstructure:"environment_vars_file"`
+
 	// An array of multiple scripts to run.
 	Scripts []string `mapstructure:"scripts"`
 
+	// A directory of scripts to run, in order of name, after any listed
+	// in scripts. Only files matching scripts_glob, by default "*.sh",
+	// are run.
+	ScriptsDir  string `mapstructure:"scripts_dir"`
+	ScriptsGlob string `mapstructure:"scripts_glob"`
+
+	// What to do with the artifact: "execute", the default, runs the
+	// scripts against it, while "copy" copies its files into the target
+	// directory without running any scripts.
+	Mode string `mapstructure:"mode"`
+
+	// A template for the directory the artifact files are copied into in
+	// "copy" mode, such as "{{.Provider}}/{{.BuildName}}".
 	TargetPath string `mapstructure:"target"`
 
+	// Builder types to run for, or to skip. Artifacts from other builders
+	// are passed through untouched. Only one of these may be set. Packer
+	// reserves "only" and "except" for filtering by build name, and never
+	// passes them on.
+	OnlyBuilderTypes   []string `mapstructure:"only_builder_types"`
+	ExceptBuilderTypes []string `mapstructure:"except_builder_types"`
+
+	// The expected SHA-256 checksums of scripts, keyed by script path.
+	// Scripts whose contents don't match aren't run.
+	ScriptChecksums map[string]string `mapstructure:"script_checksums"`
+
+	// Extra environment variables for individual scripts, keyed by their
+	// path as listed in scripts. They are added to environment_vars when
+	// that script is run.
+	ScriptEnvironments map[string]map[string]string `mapstructure:"script_environments"`
+
+	// Scripts run a single time, without an artifact file argument, before
+	// and after the scripts are run against each artifact file.
+	PreScripts  []string `mapstructure:"pre_scripts"`
+	PostScripts []string `mapstructure:"post_scripts"`
+
+	// A script that is always run once the other scripts have finished,
+	// even if they failed, with the artifact files as its arguments.
+	CleanupScript string `mapstructure:"cleanup_script"`
+
+	// Only run against the final artifact of a chain of post-processors,
+	// returning other artifacts unchanged. See isFinalArtifact.
+	RunOnFinalOnly bool `mapstructure:"run_on_final_only"`
+
+	// The builder IDs of the artifacts run_on_final_only runs against, such
+	// as "packer.post-processor.compress" for the output of the compress
+	// post-processor.
+	FinalBuilderIds []string `mapstructure:"final_builder_ids"`
+
+	// What is returned for artifacts skipped by only_builder_types or
+	// except_builder_types: "original" for the artifact itself, "empty"
+	// for an artifact without files, or "error" to fail. Defaults to
+	// "original".
+	SkipReturns string `mapstructure:"skip_returns"`
+
+	// Keep running the remaining scripts when one fails, collecting
+	// every failure instead of stopping at the first one.
+	ContinueOnError bool `mapstructure:"continue_on_error"`
+
+	// Whether failures collected with continue_on_error cause the
+	// post-processor to fail. Defaults to true.
+	FailOnAnyError *bool `mapstructure:"fail_on_any_error"`
+
+	// Leave the generated inline script on disk after running so it
+	// can be inspected.
+	KeepTempScript bool `mapstructure:"keep_temp_script"`
+
+	// The directory the inline script is written to. Defaults to the
+	// system temporary directory.
+	TempDir string `mapstructure:"temp_dir"`
+
+	// Download artifact files that are http(s) URLs to temporary files
+	// and pass those to the scripts instead.
+	DownloadRemoteArtifacts bool `mapstructure:"download_remote_artifacts"`
+
+	// Bundle the artifact files into an archive at archive_path, either
+	// "tar.gz" or "zip", and run the scripts against the archive.
+	Archive     string `mapstructure:"archive"`
+	ArchivePath string `mapstructure:"archive_path"`
+
+	// When the artifact is a single directory, run the scripts against
+	// each file within it, recursively, instead of the directory.
+	RecurseDirectory bool `mapstructure:"recurse_directory"`
+
+	// A template for a directory, such as "{{.Provider}}/{{.BuildName}}",
+	// that the artifact files are moved into after the scripts have run.
+	OutputStructure string `mapstructure:"output_structure"`
+
+	// The octal permissions, such as "0750", of the directory created for
+	// output_structure or target and of the files placed in it. The directory
+	// defaults to 0755 and the files keep their permissions.
+	RawTargetDirMode  string `mapstructure:"target_dir_mode"`
+	RawTargetFileMode string `mapstructure:"target_file_mode"`
+
+	// Place the files in the output_structure or target directory all or
+	// nothing: each is renamed, and if one can't be, those already placed
+	// are put back.
+	Finalize bool `mapstructure:"finalize"`
+
+	// Convert CRLF line endings in scripts to LF before running them.
+	// When false, scripts with CRLF line endings cause a warning.
+	NormalizeLineEndings bool `mapstructure:"normalize_line_endings"`
+
+	// Interpolate the contents of each script before running it.
+	TemplateScripts bool `mapstructure:"template_scripts"`
+
+	// Log a diff of each text artifact file's contents before and after
+	// the scripts have run.
+	EmitDiff bool `mapstructure:"emit_diff"`
+
+	// How long to wait before running each script, such as "10s".
+	RawPauseBefore string `mapstructure:"pause_before"`
+
+	// State keys copied from the input artifact to the returned one.
+	PassthroughState []string `mapstructure:"passthrough_state"`
+
+	// The provider the artifact is for. When unset, the artifact's
+	// "provider" state is used, then a guess based on its builder. A
+	// comma-separated list produces a composite artifact for each of them.
+	Provider string `mapstructure:"provider"`
+
+	// A glob matching the files the scripts produce. When set, the
+	// returned artifact lists the matching files instead of the input
+	// artifact's files.
+	OutputFiles string `mapstructure:"output_files"`
+
+	// Environment variables set for later scripts from the output of
+	// earlier ones, keyed by name. Each value is a regular expression
+	// matched against each script's stdout; the variable is set to its
+	// first group, or the whole match when it has none.
+	CaptureVars map[string]string `mapstructure:"capture_vars"`
+
+	// A regular expression the stdout of the last script run must match
+	// for a new artifact to be produced. When it does not match, the
+	// input artifact is returned unchanged.
+	ProduceIfOutput string `mapstructure:"produce_if_output"`
+
+	// The order the artifact files are processed in: "none" keeps the
+	// builder's order, "name" sorts them by path and "size" by size.
+	SortFiles string `mapstructure:"sort_files"`
+
+	// Only run the scripts against artifact files with one of these
+	// extensions, such as ".vmdk". All files are processed when empty.
+	Extensions []string `mapstructure:"extensions"`
+
+	// Only run the scripts against the artifact file at this index in the
+	// artifact's list of files. All files are processed when unset.
+	FileIndex *int `mapstructure:"file_index"`
+
+	// Run the scripts in the directory holding the artifact file they are
+	// run against, instead of the current directory.
+	ChdirToArtifact bool `mapstructure:"chdir_to_artifact"`
+
+	// The CPUs, numbered from 0, the scripts are restricted to running
+	// on. Only supported on Linux.
+	CPUAffinity []int `mapstructure:"cpu_affinity"`
+
+	// Pass each script an open, read-only file descriptor for the artifact
+	// file, whose number is exported as PACKER_ARTIFACT_FD.
+	PassArtifactFd bool `mapstructure:"pass_artifact_fd"`
+
+	// Fail if the artifact has no files.
+	RequireFiles bool `mapstructure:"require_files"`
+
+	// Fail without running any scripts if an artifact file is larger than
+	// this many bytes. Unlimited when 0.
+	MaxArtifactSizeBytes int64 `mapstructure:"max_artifact_size_bytes"`
+
+	// Run each script a single time, without an artifact file argument,
+	// instead of once per artifact file.
+	RunOnce bool `mapstructure:"run_once"`
+
+	// The checksum to compute for each artifact file and export as
+	// PACKER_ARTIFACT_CHECKSUM. One of "md5", "sha1", "sha256" or "none".
+	ComputeChecksum string `mapstructure:"compute_checksum"`
+
+	// Write each computed checksum next to its artifact file, in a file
+	// named after the checksum type.
+	ChecksumSidecar bool `mapstructure:"checksum_sidecar"`
+
+	// Delays between successive attempts at running a failed script,
+	// such as ["1s", "5s", "30s"]. A script is retried once per entry.
+	RetrySchedule []string `mapstructure:"retry_schedule"`
+
+	// As an alternative to retry_schedule, the number of times to retry a
+	// failed script, waiting retry_delay in between. With a retry_backoff
+	// of "exponential" the delay doubles after each attempt, up to
+	// retry_max_delay when set.
+	Retries          int    `mapstructure:"retries"`
+	RetryBackoff     string `mapstructure:"retry_backoff"`
+	RawRetryDelay    string `mapstructure:"retry_delay"`
+	RawRetryMaxDelay string `mapstructure:"retry_max_delay"`
+
+	// Pass the host's SSH_AUTH_SOCK through to the scripts so they can use
+	// its SSH agent.
+	ForwardSSHAgent bool `mapstructure:"forward_ssh_agent"`
+
+	// A shell command run against each artifact file, as $1, before the
+	// scripts. Processing is aborted if it fails.
+	PrecheckCommand string `mapstructure:"precheck_command"`
+
+	// A shell command run once, with the artifact files as arguments,
+	// before anything else. If it succeeds the work is taken to be done
+	// already, and the artifact is returned without running the scripts.
+	IdempotencyCheck string `mapstructure:"idempotency_check"`
+
+	// The user to run the scripts as.
+	RunAs string `mapstructure:"run_as"`
+
+	// The command prefix used to run scripts as run_as. The user is
+	// available as {{.User}}.
+	SudoCommand string `mapstructure:"sudo_command"`
+
+	// Write the build's details to a JSON file whose path is exported to
+	// the scripts as PACKER_VARS_FILE.
+	WriteVarsFile bool `mapstructure:"write_vars_file"`
+
+	// Capture the scripts' stdout and stderr together, in the order they
+	// were written, instead of separately.
+	CaptureCombined bool `mapstructure:"capture_combined"`
+
+	// Show what would be run for the artifact without running anything.
+	DryRun bool `mapstructure:"dry_run"`
+
+	// Prepare and syntax check the scripts, and show what would be run,
+	// without running anything.
+	ValidateOnly bool `mapstructure:"validate_only"`
+
+	// Files of a sample artifact used to check the templates that depend
+	// on the artifact when dry_run is set.
+	SampleArtifactFiles []string `mapstructure:"sample_artifact_files"`
+
+	// Run the scripts under strace (Linux) or dtruss (macOS), writing the
+	// trace of every script to trace_output.
+	Trace       bool   `mapstructure:"trace"`
+	TraceOutput string `mapstructure:"trace_output"`
+
+	// Fail a script, killing it, as soon as it writes to stderr.
+	FailOnFirstStderr bool `mapstructure:"fail_on_first_stderr"`
+
+	// A file whose existence, checked before each script is run, aborts
+	// processing.
+	AbortFile string `mapstructure:"abort_file"`
+
+	// Show which file is being processed out of how many. Defaults to
+	// true.
+	ShowProgress *bool `mapstructure:"show_progress"`
+
+	// How many of the last lines of a failed script's stderr are included
+	// in the error. All of it is included when 0.
+	StderrTailLines int `mapstructure:"stderr_tail_lines"`
+
+	// The most output kept from each script, in bytes, for each of stdout
+	// and stderr. Defaults to 10MB; 0 keeps all of it.
+	MaxOutputBytes *int64 `mapstructure:"max_output_bytes"`
+
+	// Don't wait for processes that scripts leave running in the
+	// background to close their output before moving on.
+	AllowDaemonize bool `mapstructure:"allow_daemonize"`
+
+	// A file holding a counter that is incremented on every run and
+	// exported as PACKER_RUN_SEQ.
+	SequenceFile string `mapstructure:"sequence_file"`
+
+	// A template for the path of a file that each script's command line,
+	// stdout and stderr are appended to. {{.ArtifactName}} and
+	// {{.BuildName}} are available.
+	OutputLog string `mapstructure:"output_log"`
+
+	// The path of a JSON file listing the result of each script run,
+	// written once the scripts have finished.
+	ResultFile string `mapstructure:"result_file"`
+
+	// Log the details of the artifact being processed.
+	Debug bool `mapstructure:"debug"`
+
+	pauseBefore     time.Duration
+	scriptChecksums map[string]string
+	scriptEnvs      map[string][]string
+	retrySchedule   []time.Duration
+	produceIfOutput *regexp.Regexp
+	providers       []string
+	captureVars     map[string]*regexp.Regexp
+	targetDirMode   os.FileMode
+	targetFileMode  os.FileMode
+
 	ctx interpolate.Context
 }
 
 type PostProcessor struct {
 	config Config
+
+	// Problems found by Configure that aren't severe enough to fail it.
+	// They are shown to the user when PostProcess runs.
+	warnings []string
+
+	// The output of the scripts run by the last call to PostProcess, of
+	// which no more than max_output_bytes is kept.
+	lastOutput limitedBuffer
+
+	// The checksum sidecars written by the current call to PostProcess,
+	// keyed by the file they are for, which placeFiles moves them along
+	// with.
+	sidecars map[string]string
 }
 
 type OutputPathTemplate struct {
@@ -52,12 +429,53 @@ type OutputPathTemplate struct {
 	Provider   string
 }
 
+// BuildVars is the content of the file written for write_vars_file.
+type BuildVars struct {
+	BuildName   string   `json:"build_name"`
+	BuilderType string   `json:"builder_type"`
+	ArtifactId  string   `json:"artifact_id"`
+	Files       []string `json:"files"`
+	Provider    string   `json:"provider"`
+}
+
+// ScriptResult is the entry written to result_file for each script run.
+type ScriptResult struct {
+	Script          string  `json:"script"`
+	File            string  `json:"file"`
+	ExitCode        int     `json:"exit_code"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Success         bool    `json:"success"`
+}
+
+type OutputLogTemplate struct {
+	ArtifactName string
+	BuildName    string
+}
+
+type SudoCommandTemplate struct {
+	User string
+}
+
+type ScriptTemplate struct {
+	ArtifactId  string
+	BuildName   string
+	BuilderType string
+	Provider    string
+}
+
 func (p *PostProcessor) Configure(raws ...interface{}) error {
+	p.warnings = nil
+
 	err := config.Decode(&p.config, &config.DecodeOpts{
 		Interpolate:        true,
 		InterpolateContext: &p.config.ctx,
 		InterpolateFilter: &interpolate.RenderFilter{
-			Exclude: []string{},
+			Exclude: []string{
+				"output_log",
+				"output_structure",
+				"sudo_command",
+				"target",
+			},
 		},
 	}, raws...)
 	if err != nil {
@@ -66,10 +484,18 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 
 	errs := new(packer.MultiError)
 
-	if p.config.InlineShebang == "" {
+	if strings.TrimSpace(p.config.InlineShebang) == "" {
 		p.config.InlineShebang = "/bin/sh"
 	}
 
+	if p.config.ScriptsGlob == "" {
+		p.config.ScriptsGlob = "*.sh"
+	}
+
+	if p.config.InlineSeparator == "" {
+		p.config.InlineSeparator = "\n"
+	}
+
 	if p.config.Scripts == nil {
 		p.config.Scripts = make([]string, 0)
 	}
@@ -78,6 +504,94 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 		p.config.Vars = make([]string, 0)
 	}
 
+	if len(p.config.OnlyBuilderTypes) > 0 && len(p.config.ExceptBuilderTypes) > 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of only_builder_types or except_builder_types can be specified."))
+	}
+
+	for n, builders := range map[string][]string{
+		"only_builder_types":   p.config.OnlyBuilderTypes,
+		"except_builder_types": p.config.ExceptBuilderTypes,
+	} {
+		for i, builder := range builders {
+			if strings.TrimSpace(builder) == "" {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("%s[%d] must not be empty.", n, i))
+			}
+		}
+	}
+
+	if p.config.ClearEnv != nil {
+		if *p.config.ClearEnv && p.config.InheritEnvironment {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("clear_env can't be true when inherit_environment is set."))
+		}
+		if !*p.config.ClearEnv {
+			p.config.InheritEnvironment = true
+		}
+	}
+
+	if p.config.MinimalPath == "" {
+		p.config.MinimalPath = "/usr/bin:/bin"
+	}
+
+	if len(p.config.EnvPrecedence) == 0 {
+		p.config.EnvPrecedence = defaultEnvPrecedence
+	}
+	if p.config.InheritEnvironment && !containsString(p.config.EnvPrecedence, envInherited) {
+		p.config.EnvPrecedence = append([]string{envInherited}, p.config.EnvPrecedence...)
+	}
+	if p.config.NormalizeEnvCase == "" {
+		p.config.NormalizeEnvCase = "preserve"
+	}
+	if p.config.NormalizeEnvCase != "preserve" && p.config.NormalizeEnvCase != "upper" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("normalize_env_case must be one of preserve or upper: %s", p.config.NormalizeEnvCase))
+	}
+
+	if err := validateEnvPrecedence(p.config.EnvPrecedence); err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Bad env_precedence: %s", err))
+	}
+
+	if p.config.ShowProgress == nil {
+		showProgress := true
+		p.config.ShowProgress = &showProgress
+	}
+
+	if p.config.StderrTailLines < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("stderr_tail_lines must not be negative: %d", p.config.StderrTailLines))
+	}
+
+	if p.config.MaxOutputBytes == nil {
+		maxOutputBytes := defaultMaxOutputBytes
+		p.config.MaxOutputBytes = &maxOutputBytes
+	} else if *p.config.MaxOutputBytes < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("max_output_bytes must not be negative: %d", *p.config.MaxOutputBytes))
+	}
+
+	if p.config.RunOnFinalOnly && len(p.config.FinalBuilderIds) == 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("run_on_final_only requires final_builder_ids."))
+	}
+
+	if p.config.SkipReturns == "" {
+		p.config.SkipReturns = "original"
+	}
+	switch p.config.SkipReturns {
+	case "original", "empty", "error":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("skip_returns must be one of original, empty or error: %s", p.config.SkipReturns))
+	}
+
+	if p.config.FailOnAnyError == nil {
+		failOnAnyError := true
+		p.config.FailOnAnyError = &failOnAnyError
+	}
+
 	if p.config.Script != "" && len(p.config.Scripts) > 0 {
 		errs = packer.MultiErrorAppend(errs,
 			errors.New("Only one of script or scripts can be specified."))
@@ -92,9 +606,23 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 			errs, fmt.Errorf("Error parsing target template: %s", err))
 	}
 
+	if err = interpolate.Validate(p.config.OutputLog, &p.config.ctx); err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Error parsing output_log template: %s", err))
+	}
+
+	if err = interpolate.Validate(p.config.OutputStructure, &p.config.ctx); err != nil {
+		errs = packer.MultiErrorAppend(
+			errs, fmt.Errorf("Error parsing output_structure template: %s", err))
+	}
+
 	templates := map[string]*string{
-		"inline_shebang": &p.config.InlineShebang,
-		"script":         &p.config.Script,
+		"inline_shebang":        &p.config.InlineShebang,
+		"inline_extension":      &p.config.InlineExtension,
+		"inline_prologue":       &p.config.InlinePrologue,
+		"script":                &p.config.Script,
+		"temp_dir":              &p.config.TempDir,
+		"environment_vars_file": &p.config.VarsFile,
 	}
 
 	for n, ptr := range templates {
@@ -106,9 +634,10 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 	}
 
 	sliceTemplates := map[string][]string{
-		"inline":           p.config.Inline,
-		"scripts":          p.config.Scripts,
-		"environment_vars": p.config.Vars,
+		"inline":              p.config.Inline,
+		"inline_shebang_args": p.config.InlineShebangArgs,
+		"scripts":             p.config.Scripts,
+		"environment_vars":    p.config.Vars,
 	}
 
 	for n, slice := range sliceTemplates {
@@ -122,104 +651,2368 @@ func (p *PostProcessor) Configure(raws ...interface{}) error {
 		}
 	}
 
-	if len(p.config.Scripts) == 0 && p.config.Inline == nil {
-		errs = packer.MultiErrorAppend(errs,
-			errors.New("Either a script file or inline script must be specified."))
-	} else if len(p.config.Scripts) > 0 && p.config.Inline != nil {
+	if p.config.ScriptsDir != "" {
+		scripts, err := findScripts(p.config.ScriptsDir, p.config.ScriptsGlob)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad scripts_dir '%s': %s", p.config.ScriptsDir, err))
+		}
+		p.config.Scripts = append(p.config.Scripts, scripts...)
+	}
+
+	if p.config.Mode == "" {
+		p.config.Mode = "execute"
+	}
+	switch p.config.Mode {
+	case "execute":
+	case "copy":
+		if p.config.TargetPath == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("target must be specified when mode is copy."))
+		}
+	default:
 		errs = packer.MultiErrorAppend(errs,
-			errors.New("Only a script file or an inline script can be specified, not both."))
+			fmt.Errorf("mode must be one of execute or copy: %s", p.config.Mode))
 	}
 
-	for _, path := range p.config.Scripts {
-		if _, err := os.Stat(path); err != nil {
+	if p.config.InlineBase64 != "" {
+		if p.config.Inline != nil {
 			errs = packer.MultiErrorAppend(errs,
-				fmt.Errorf("Bad script '%s': %s", path, err))
+				errors.New("Only one of inline or inline_base64 can be specified."))
+		}
+		if _, err := base64.StdEncoding.DecodeString(p.config.InlineBase64); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad inline_base64: %s", err))
 		}
 	}
 
-	// Do a check for bad environment variables, such as '=foo', 'foobar'
-	for _, kv := range p.config.Vars {
-		vs := strings.SplitN(kv, "=", 2)
-		if len(vs) != 2 || vs[0] == "" {
+	// Scripts aren't run in copy mode, so none are needed.
+	if p.config.Mode != "copy" && len(p.config.Scripts) == 0 && !p.hasInline() && len(p.config.InlineScripts) == 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Either a script file, inline script or inline_scripts must be specified."))
+	} else if len(p.config.Scripts) > 0 && p.hasInline() {
+		if len(p.config.InlineScripts) > 0 {
 			errs = packer.MultiErrorAppend(errs,
-				fmt.Errorf("Environment variable not in format 'key=value': %s", kv))
+				errors.New("Only two of script files, inline script and inline_scripts can be specified, not all three."))
+		} else {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Only a script file or an inline script can be specified, not both."))
 		}
 	}
 
-	if errs != nil && len(errs.Errors) > 0 {
-		return errs
+	for name := range p.config.InlineScripts {
+		if name == "" || name != filepath.Base(name) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("inline_scripts name must be a filename without a directory: '%s'", name))
+		}
 	}
 
-	return nil
-}
+	if p.config.CleanupScript != "" {
+		path, err := expandTilde(p.config.CleanupScript)
+		if err == nil {
+			_, err = os.Stat(path)
+		}
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad cleanup_script '%s': %s", p.config.CleanupScript, err))
+		}
+		p.config.CleanupScript = path
+	}
 
-func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
-	scripts := make([]string, len(p.config.Scripts))
-	copy(scripts, p.config.Scripts)
+	paths := map[string]*string{
+		"temp_dir":      &p.config.TempDir,
+		"trace_output":  &p.config.TraceOutput,
+		"result_file":   &p.config.ResultFile,
+		"sequence_file": &p.config.SequenceFile,
+		"archive_path":  &p.config.ArchivePath,
+		"abort_file":    &p.config.AbortFile,
+	}
 
-	if p.config.Inline != nil {
-		tf, err := ioutil.TempFile("", "packer-shell")
+	for n, ptr := range paths {
+		path, err := expandTilde(*ptr)
 		if err != nil {
-			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad %s '%s': %s", n, *ptr, err))
+			continue
 		}
-		defer os.Remove(tf.Name())
+		*ptr = path
+	}
 
-		// Set the path to the temporary file
-		scripts = append(scripts, tf.Name())
+	// Scripts may be listed more than once, so only check each path the
+	// first time it's seen.
+	checked := make(map[string]bool)
+	missing := make(map[string]bool)
+	for i, path := range p.config.Scripts {
+		path, err = expandTilde(path)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script '%s': %s", p.config.Scripts[i], err))
+			continue
+		}
+		p.config.Scripts[i] = path
 
-		// Write our contents to it
-		writer := bufio.NewWriter(tf)
-		writer.WriteString(fmt.Sprintf("#!%s\n", p.config.InlineShebang))
-		for _, command := range p.config.Inline {
-			if _, err := writer.WriteString(command + "\n"); err != nil {
-				return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+		if checked[path] {
+			continue
+		}
+		checked[path] = true
+
+		if _, err := statScript(path); os.IsNotExist(err) && p.config.SkipMissingScripts {
+			p.warn(fmt.Sprintf("Skipping script %s, which doesn't exist", path))
+			missing[path] = true
+		} else if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script '%s': %s", path, err))
+		} else if !p.config.NormalizeLineEndings {
+			if contents, err := ioutil.ReadFile(path); err == nil && bytes.Contains(contents, []byte("\r\n")) {
+				p.warn(fmt.Sprintf(
+					"Script %s has CRLF line endings, which the shell may not understand; set normalize_line_endings to convert them", path))
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		scripts := make([]string, 0, len(p.config.Scripts))
+		for _, path := range p.config.Scripts {
+			if !missing[path] {
+				scripts = append(scripts, path)
 			}
 		}
+		p.config.Scripts = scripts
 
-		if err := writer.Flush(); err != nil {
-			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+		if len(scripts) == 0 && !p.hasInline() && len(p.config.InlineScripts) == 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("None of the scripts exist, so there is nothing to run."))
 		}
+	}
 
-		tf.Close()
+	for name, paths := range map[string][]string{
+		"pre_scripts":  p.config.PreScripts,
+		"post_scripts": p.config.PostScripts,
+	} {
+		for i, path := range paths {
+			path, err := expandTilde(path)
+			if err == nil {
+				_, err = os.Stat(path)
+			}
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Bad %s script '%s': %s", name, paths[i], err))
+			}
+			paths[i] = path
+		}
 	}
 
-	envVars := make([]string, len(p.config.Vars)+2)
-	envVars[0] = "PACKER_BUILD_NAME=" + p.config.PackerBuildName
-	envVars[1] = "PACKER_BUILDER_TYPE=" + p.config.PackerBuilderType
-	copy(envVars[2:], p.config.Vars)
+	p.config.scriptChecksums = make(map[string]string)
+	for path, sum := range p.config.ScriptChecksums {
+		expanded, err := expandTilde(path)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script_checksums script '%s': %s", path, err))
+			continue
+		}
+		if !containsString(p.config.Scripts, expanded) && !missing[expanded] &&
+			!containsString(p.config.PreScripts, expanded) && !containsString(p.config.PostScripts, expanded) {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("script_checksums references a script that isn't listed: %s", path))
+		}
+		if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("script_checksums for '%s' isn't a hex encoded SHA-256 checksum: %s", path, sum))
+		}
+		p.config.scriptChecksums[expanded] = strings.ToLower(sum)
+	}
 
-	ui.Say(fmt.Sprintf("Processing artifact from: %s", artifact.BuilderId()))
-	files := artifact.Files()
-	var stderr bytes.Buffer
-	var stdout bytes.Buffer
-	fmt.Printf("%+v\n", artifact)
-	for _, art := range files {
-		for _, path := range scripts {
-			stderr.Reset()
-			stdout.Reset()
-			ui.Say(fmt.Sprintf("Process with shell script: %s", path))
+	p.config.scriptEnvs = make(map[string][]string)
+	for path, vars := range p.config.ScriptEnvironments {
+		expanded, err := expandTilde(path)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad script_environments script '%s': %s", path, err))
+			continue
+		}
+		if !containsString(p.config.Scripts, expanded) && !missing[expanded] {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("script_environments references a script that isn't listed: %s", path))
+		}
 
-			log.Printf("Opening %s for reading", path)
-			f, err := os.Open(path)
-			if err != nil {
-				return nil, false, fmt.Errorf("Error opening shell script: %s", err)
+		keys := make([]string, 0, len(vars))
+		for key := range vars {
+			if key == "" || strings.Contains(key, "=") {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Bad script_environments variable for '%s': '%s'", path, key))
+				continue
 			}
-			defer f.Close()
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			p.config.scriptEnvs[expanded] = append(p.config.scriptEnvs[expanded], key+"="+vars[key])
+		}
+	}
 
-			ui.Message(fmt.Sprintf("Executing script with artifact: %s", art))
-			args := []string{path, art}
-			cmd := exec.Command("/bin/sh", args...)
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			cmd.Env = envVars
-			err = cmd.Run()
-			ui.Message(fmt.Sprintf("%s", stdout.String()))
-			if err != nil {
-				return nil, false, fmt.Errorf("Unable to execute script: %s", stderr.String())
+	if p.hasInline() || len(p.config.InlineScripts) > 0 {
+		if fields := strings.Fields(p.config.InlineShebang); len(fields) == 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("inline_shebang must not be empty."))
+		} else if _, err := exec.LookPath(fields[0]); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Inline shebang interpreter '%s' not found: %s", fields[0], err))
+		}
+	}
+
+	if _, err := filepath.Match(p.config.OutputFiles, ""); err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Bad output_files pattern '%s': %s", p.config.OutputFiles, err))
+	}
+
+	if strings.Contains(p.config.Provider, ",") {
+		for _, provider := range strings.Split(p.config.Provider, ",") {
+			provider = strings.TrimSpace(provider)
+			if provider == "" || containsString(p.config.providers, provider) {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("provider must be a list of distinct, non-empty providers: %s", p.config.Provider))
+				break
 			}
+			p.config.providers = append(p.config.providers, provider)
 		}
 	}
-	newArtifact := NewArtifact(artifact)
+
+	p.config.captureVars = make(map[string]*regexp.Regexp)
+	for name, pattern := range p.config.CaptureVars {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad capture_vars name '%s': must be a valid environment variable name", name))
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad capture_vars pattern for %s '%s': %s", name, pattern, err))
+			continue
+		}
+		p.config.captureVars[name] = re
+	}
+
+	if p.config.ProduceIfOutput != "" {
+		if p.config.produceIfOutput, err = regexp.Compile(p.config.ProduceIfOutput); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad produce_if_output pattern '%s': %s", p.config.ProduceIfOutput, err))
+		}
+	}
+
+	if p.config.ComputeChecksum == "" {
+		p.config.ComputeChecksum = "none"
+	}
+	if _, ok := checksumTypes[p.config.ComputeChecksum]; !ok && p.config.ComputeChecksum != "none" {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("compute_checksum must be one of md5, sha1, sha256 or none: %s", p.config.ComputeChecksum))
+	}
+
+	if p.config.ChecksumSidecar && p.config.ComputeChecksum == "none" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("checksum_sidecar requires compute_checksum to be set."))
+	}
+
+	for i, ext := range p.config.Extensions {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("extensions[%d] must start with a dot, like '.vmdk': %s", i, ext))
+		}
+	}
+	if len(p.config.Extensions) > 0 && p.config.RunOnce {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("extensions can't be used with run_once, which doesn't process individual files."))
+	}
+
+	if p.config.SortFiles == "" {
+		p.config.SortFiles = "none"
+	}
+	switch p.config.SortFiles {
+	case "none", "name", "size":
+	default:
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("sort_files must be one of none, name or size: %s", p.config.SortFiles))
+	}
+
+	if p.config.FileIndex != nil {
+		if *p.config.FileIndex < 0 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("file_index must not be negative: %d", *p.config.FileIndex))
+		}
+		if len(p.config.Extensions) > 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Only one of file_index or extensions can be specified."))
+		}
+		if p.config.RunOnce {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("file_index can't be used with run_once, which doesn't process individual files."))
+		}
+	}
+
+	if len(p.config.CPUAffinity) > 0 {
+		if runtime.GOOS != "linux" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("cpu_affinity is only supported on linux."))
+		} else if _, err := exec.LookPath("taskset"); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("cpu_affinity requires taskset: %s", err))
+		}
+	}
+	for i, cpu := range p.config.CPUAffinity {
+		if cpu < 0 || cpu >= maxCPUs {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("cpu_affinity[%d] must be between 0 and %d: %d", i, maxCPUs-1, cpu))
+		}
+	}
+
+	if p.config.MaxArtifactSizeBytes < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("max_artifact_size_bytes must not be negative: %d", p.config.MaxArtifactSizeBytes))
+	}
+
+	if p.config.PassArtifactFd && runtime.GOOS == "windows" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("pass_artifact_fd isn't supported on windows."))
+	}
+
+	// sudo closes the descriptors it doesn't own, so the script would
+	// never see the artifact's.
+	if p.config.PassArtifactFd && p.config.RunAs != "" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("Only one of pass_artifact_fd or run_as can be specified."))
+	}
+
+	if p.config.RunOnce && p.config.ComputeChecksum != "none" {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("compute_checksum can't be used with run_once, which doesn't process individual files."))
+	}
+
+	p.config.targetDirMode = 0755
+	if p.config.RawTargetDirMode != "" {
+		mode, err := strconv.ParseUint(p.config.RawTargetDirMode, 8, 32)
+		if err != nil || mode > 0777 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad target_dir_mode '%s': must be octal permissions such as 0750", p.config.RawTargetDirMode))
+		}
+		p.config.targetDirMode = os.FileMode(mode)
+	}
+
+	if p.config.RawTargetFileMode != "" {
+		mode, err := strconv.ParseUint(p.config.RawTargetFileMode, 8, 32)
+		if err != nil || mode > 0777 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad target_file_mode '%s': must be octal permissions such as 0640", p.config.RawTargetFileMode))
+		}
+		p.config.targetFileMode = os.FileMode(mode)
+	}
+
+	if p.config.RawPauseBefore != "" {
+		p.config.pauseBefore, err = time.ParseDuration(p.config.RawPauseBefore)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing pause_before: %s", err))
+		} else if p.config.pauseBefore < 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("pause_before must not be negative."))
+		}
+	}
+
+	p.config.retrySchedule = make([]time.Duration, len(p.config.RetrySchedule))
+	for i, raw := range p.config.RetrySchedule {
+		delay, err := time.ParseDuration(raw)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing retry_schedule[%d]: %s", i, err))
+		} else if delay < 0 {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("retry_schedule[%d] must not be negative.", i))
+		}
+		p.config.retrySchedule[i] = delay
+	}
+
+	if p.config.RetryBackoff == "" {
+		p.config.RetryBackoff = "fixed"
+	}
+	if !containsString(retryBackoffs, p.config.RetryBackoff) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("retry_backoff must be one of %s: %s", strings.Join(retryBackoffs, ", "), p.config.RetryBackoff))
+	}
+
+	if p.config.RawRetryDelay == "" {
+		p.config.RawRetryDelay = "1s"
+	}
+	retryDelay, err := time.ParseDuration(p.config.RawRetryDelay)
+	if err != nil {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("Failed parsing retry_delay: %s", err))
+	} else if retryDelay < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			errors.New("retry_delay must not be negative."))
+	}
+
+	var retryMaxDelay time.Duration
+	if p.config.RawRetryMaxDelay != "" {
+		retryMaxDelay, err = time.ParseDuration(p.config.RawRetryMaxDelay)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Failed parsing retry_max_delay: %s", err))
+		} else if retryMaxDelay < retryDelay {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("retry_max_delay must not be less than retry_delay."))
+		}
+	}
+
+	if p.config.Retries < 0 {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("retries must not be negative: %d", p.config.Retries))
+	} else if p.config.Retries > 0 {
+		if len(p.config.RetrySchedule) > 0 {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("Only one of retries or retry_schedule can be specified."))
+		}
+		for attempt := 0; attempt < p.config.Retries; attempt++ {
+			p.config.retrySchedule = append(p.config.retrySchedule,
+				backoffDelay(p.config.RetryBackoff, retryDelay, retryMaxDelay, attempt))
+		}
+	}
+
+	if p.config.Trace {
+		if p.config.TraceOutput == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("trace_output must be specified when trace is enabled."))
+		}
+
+		if tracer, ok := tracers[runtime.GOOS]; !ok {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("trace isn't supported on %s.", runtime.GOOS))
+		} else if _, err := exec.LookPath(tracer[0]); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("trace requires %s: %s", tracer[0], err))
+		}
+	}
+
+	if p.config.Archive != "" {
+		if _, ok := archiveFormats[p.config.Archive]; !ok {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("archive must be one of tar.gz or zip: %s", p.config.Archive))
+		}
+		if p.config.ArchivePath == "" {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("archive_path must be specified when archive is set."))
+		}
+	}
+
+	if p.config.SudoCommand == "" {
+		p.config.SudoCommand = "sudo -n -E -u {{.User}}"
+	}
+
+	if p.config.RunAs != "" {
+		if _, err := user.Lookup(p.config.RunAs); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad run_as user '%s': %s", p.config.RunAs, err))
+		}
+
+		if err := interpolate.Validate(p.config.SudoCommand, &p.config.ctx); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error parsing sudo_command template: %s", err))
+		}
+	}
+
+	if strings.ContainsAny(p.config.InlineExtension, `/\`) {
+		errs = packer.MultiErrorAppend(errs,
+			fmt.Errorf("inline_extension must not contain path separators: %s", p.config.InlineExtension))
+	}
+
+	if p.config.TempDir != "" {
+		if err := validateTempDir(p.config.TempDir); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad temp_dir '%s': %s", p.config.TempDir, err))
+		}
+	}
+
+	if p.config.VarsFile != "" {
+		vars, err := p.readVarsFile(p.config.VarsFile)
+		if err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Bad environment_vars_file '%s': %s", p.config.VarsFile, err))
+		}
+		p.config.Vars = append(p.config.Vars, vars...)
+	}
+
+	// Do a check for bad environment variables, such as '=foo', 'foobar'
+	seenVars := make(map[string]bool)
+	for _, kv := range p.config.Vars {
+		vs := strings.SplitN(kv, "=", 2)
+		if len(vs) != 2 || vs[0] == "" {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Environment variable not in format 'key=value': %s", kv))
+			continue
+		}
+
+		key := vs[0]
+		if p.config.NormalizeEnvCase == "upper" {
+			key = strings.ToUpper(key)
+		}
+		if seenVars[key] {
+			p.warn(fmt.Sprintf(
+				"Environment variable %s is set more than once; the last value wins", key))
+		}
+		seenVars[key] = true
+	}
+
+	if len(p.config.SampleArtifactFiles) > 0 {
+		if !p.config.DryRun {
+			errs = packer.MultiErrorAppend(errs,
+				errors.New("sample_artifact_files can only be used with dry_run."))
+		} else if errs == nil || len(errs.Errors) == 0 {
+			sample := &Artifact{
+				builderId: "sample",
+				files:     p.config.SampleArtifactFiles,
+				id:        "sample",
+				state:     make(map[string]interface{}),
+			}
+			if err := p.checkTemplates(sample); err != nil {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Error rendering templates for sample artifact: %s", err))
+			}
+		}
+	}
+
+	if errs != nil && len(errs.Errors) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// statScript checks that a script exists. Tests replace it to count the
+// checks made.
+var statScript = os.Stat
+
+// expandTilde replaces a leading "~" in path with the current user's
+// home directory. Paths of the form "~user/..." are left untouched.
+func expandTilde(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("Error expanding home directory: %s", err)
+	}
+
+	return filepath.Join(home, path[1:]), nil
+}
+
+// scriptTemplate returns the data available to scripts interpolated with
+// template_scripts.
+func (p *PostProcessor) scriptTemplate(artifact packer.Artifact) *ScriptTemplate {
+	return &ScriptTemplate{
+		ArtifactId:  artifact.Id(),
+		BuildName:   p.config.PackerBuildName,
+		BuilderType: p.config.PackerBuilderType,
+		Provider:    p.provider(artifact),
+	}
+}
+
+// checkTemplates renders each template that depends on the artifact
+// against it, without running anything, and returns any errors.
+func (p *PostProcessor) checkTemplates(artifact packer.Artifact) error {
+	errs := new(packer.MultiError)
+
+	if p.config.TemplateScripts {
+		p.config.ctx.Data = p.scriptTemplate(artifact)
+		for _, path := range p.config.Scripts {
+			contents, err := ioutil.ReadFile(path)
+			if err == nil {
+				_, err = interpolate.Render(string(contents), &p.config.ctx)
+			}
+			if err != nil {
+				errs = packer.MultiErrorAppend(errs,
+					fmt.Errorf("Error interpolating script %s: %s", path, err))
+			}
+		}
+	}
+
+	if p.config.OutputStructure != "" {
+		p.config.ctx.Data = &OutputPathTemplate{
+			ArtifactId: artifact.Id(),
+			BuildName:  p.config.PackerBuildName,
+			Provider:   p.provider(artifact),
+		}
+		if _, err := interpolate.Render(p.config.OutputStructure, &p.config.ctx); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error rendering output_structure template: %s", err))
+		}
+	}
+
+	if p.config.Mode == "copy" {
+		if _, err := p.renderTarget(artifact); err != nil {
+			errs = packer.MultiErrorAppend(errs, err)
+		}
+	}
+
+	if p.config.RunAs != "" {
+		p.config.ctx.Data = &SudoCommandTemplate{User: p.config.RunAs}
+		if _, err := interpolate.Render(p.config.SudoCommand, &p.config.ctx); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Error rendering sudo_command template: %s", err))
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// warn records a configuration warning to show when PostProcess runs.
+func (p *PostProcessor) warn(message string) {
+	log.Printf("Warning: %s", message)
+	p.warnings = append(p.warnings, message)
+}
+
+// readVarsFile renders the contents of the given environment file as a
+// template and returns its non-empty, non-comment lines.
+func (p *PostProcessor) readVarsFile(path string) ([]string, error) {
+	path, err := expandTilde(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := interpolate.Render(string(contents), &p.config.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make([]string, 0)
+	for _, line := range strings.Split(rendered, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		vars = append(vars, line)
+	}
+
+	return vars, nil
+}
+
+// findScripts returns the paths of the files in dir whose names match
+// pattern, sorted by name. It is an error for there to be none.
+func findScripts(dir string, pattern string) ([]string, error) {
+	dir, err := expandTilde(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	scripts := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		matched, err := filepath.Match(pattern, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("bad scripts_glob '%s': %s", pattern, err)
+		}
+		if matched {
+			scripts = append(scripts, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	if len(scripts) == 0 {
+		return nil, fmt.Errorf("no scripts matching '%s'", pattern)
+	}
+
+	sort.Strings(scripts)
+	return scripts, nil
+}
+
+// validateTempDir checks that dir is an existing directory that we are
+// able to create files in.
+func validateTempDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New("not a directory")
+	}
+
+	tf, err := ioutil.TempFile(dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	tf.Close()
+	return os.Remove(tf.Name())
+}
+
+// orphanedTempFileAge is how old a temporary file must be before it is
+// assumed to have been left behind by a run that was killed. Younger
+// files may belong to builds running in parallel.
+const orphanedTempFileAge = 24 * time.Hour
+
+// The temporary files the post-processor creates are named with prefixes
+// no other program uses, so that sweepTempFiles only removes its own.
+// Scripts kept by keep_temp_script and downloaded artifacts are named
+// differently again, so they aren't swept either.
+const (
+	tempPrefix     = "packer-pp-shell-tmp-"
+	keptTempPrefix = "packer-pp-shell-keep-"
+	downloadPrefix = "packer-pp-shell-artifact-"
+)
+
+// sweepTempFiles removes the temporary files and directories left in dir,
+// or the system temporary directory when empty, by killed runs.
+func sweepTempFiles(dir string) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		return
+	}
+	for _, path := range matches {
+		info, err := os.Lstat(path)
+		if err != nil || time.Since(info.ModTime()) < orphanedTempFileAge {
+			continue
+		}
+		log.Printf("Removing orphaned temporary file: %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Error removing %s: %s", path, err)
+		}
+	}
+}
+
+// tempScriptPrefix returns the prefix of the temporary files inline
+// scripts are written to.
+func (p *PostProcessor) tempScriptPrefix() string {
+	if p.config.KeepTempScript {
+		return keptTempPrefix
+	}
+	return tempPrefix
+}
+
+// script is a script to run. The file executed differs from the one
+// configured when its contents had to be rewritten first.
+type script struct {
+	name   string
+	path   string
+	inline bool
+}
+
+// utf8BOM is the byte order mark some editors put at the start of UTF-8
+// files, which the shell doesn't understand.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// prepareScript checks the script at path and, when its contents need to
+// be normalized or interpolated before they can be run, writes the new
+// contents to a temporary file that is run instead.
+func (p *PostProcessor) prepareScript(path string) (script, error) {
+	s := script{name: path, path: path}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+
+	if expected, ok := p.config.scriptChecksums[path]; ok {
+		sum := sha256.Sum256(contents)
+		if actual := hex.EncodeToString(sum[:]); actual != expected {
+			return s, fmt.Errorf("Checksum mismatch: expected %s, got %s", expected, actual)
+		}
+	}
+
+	normalized := bytes.TrimPrefix(contents, utf8BOM)
+	if p.config.NormalizeLineEndings {
+		normalized = bytes.Replace(normalized, []byte("\r\n"), []byte("\n"), -1)
+	}
+	if p.config.TemplateScripts {
+		rendered, err := interpolate.Render(string(normalized), &p.config.ctx)
+		if err != nil {
+			return s, fmt.Errorf("Error interpolating script: %s", err)
+		}
+		normalized = []byte(rendered)
+	} else if len(normalized) == len(contents) {
+		return s, nil
+	}
+
+	tf, err := ioutil.TempFile(p.config.TempDir, tempPrefix+"*"+filepath.Ext(path))
+	if err != nil {
+		return s, err
+	}
+	defer tf.Close()
+
+	if _, err := tf.Write(normalized); err != nil {
+		os.Remove(tf.Name())
+		return s, err
+	}
+	if err := p.shareWithRunAs(tf.Name(), 0644); err != nil {
+		os.Remove(tf.Name())
+		return s, err
+	}
+
+	s.path = tf.Name()
+	return s, nil
+}
+
+// shareWithRunAs gives the run_as user access to path, a file or directory
+// the post-processor created for the scripts, which is otherwise private to
+// the user running Packer. path is handed to the run_as user when the
+// user running Packer may do so, or else to their group, and given mode.
+// Failing both, mode is only applied when it grants others access; a mode
+// that doesn't is meant for the run_as user alone, and is an error.
+func (p *PostProcessor) shareWithRunAs(path string, mode os.FileMode) error {
+	if p.config.RunAs == "" {
+		return nil
+	}
+
+	u, err := user.Lookup(p.config.RunAs)
+	if err != nil {
+		return err
+	}
+	uid, uidErr := strconv.Atoi(u.Uid)
+	gid, gidErr := strconv.Atoi(u.Gid)
+	if uidErr == nil && gidErr == nil {
+		err := os.Chown(path, uid, gid)
+		if err == nil {
+			return nil
+		}
+		if groupErr := os.Chown(path, -1, gid); groupErr == nil {
+			return os.Chmod(path, mode)
+		}
+		if mode&0007 == 0 {
+			return fmt.Errorf("Couldn't give %s to %s or their group: %s", path, p.config.RunAs, err)
+		}
+		log.Printf("Couldn't give %s to %s, setting its mode to %s: %s", path, p.config.RunAs, mode, err)
+	}
+	return os.Chmod(path, mode)
+}
+
+// hasInline returns whether an inline script is configured, either as
+// inline commands or inline_base64.
+func (p *PostProcessor) hasInline() bool {
+	return p.config.Inline != nil || p.config.InlineBase64 != ""
+}
+
+// inlineShebangLine returns the start of inline scripts: the shebang line
+// followed by any prologue.
+func (p *PostProcessor) inlineShebangLine() string {
+	header := fmt.Sprintf("#!%s\n",
+		strings.Join(append([]string{p.config.InlineShebang}, p.config.InlineShebangArgs...), " "))
+	if p.config.InlinePrologue != "" {
+		header += p.config.InlinePrologue + "\n"
+	}
+	return header
+}
+
+// inlineInterpreter returns the command line, without the script path,
+// used to run the inline script.
+func (p *PostProcessor) inlineInterpreter() []string {
+	return append(strings.Fields(p.config.InlineShebang), p.config.InlineShebangArgs...)
+}
+
+// writeResultFile writes results as JSON to path.
+func writeResultFile(path string, results []ScriptResult) error {
+	if results == nil {
+		results = []ScriptResult{}
+	}
+	contents, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(contents, '\n'), 0644)
+}
+
+// readOutputManifest returns the files listed, one per line, in the output
+// manifest at path, or nil when no script wrote it. Blank lines are
+// ignored.
+func readOutputManifest(path string) ([]string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0)
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// writeVarsFile writes the build's details as JSON to a new temporary file
+// and returns its path.
+func (p *PostProcessor) writeVarsFile(artifact packer.Artifact, files []string) (string, error) {
+	contents, err := json.MarshalIndent(&BuildVars{
+		BuildName:   p.config.PackerBuildName,
+		BuilderType: p.config.PackerBuilderType,
+		ArtifactId:  artifact.Id(),
+		Files:       files,
+		Provider:    p.provider(artifact),
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	tf, err := ioutil.TempFile(p.config.TempDir, tempPrefix+"vars-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer tf.Close()
+
+	if _, err := tf.Write(contents); err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+	if err := p.shareWithRunAs(tf.Name(), 0644); err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+
+	return tf.Name(), nil
+}
+
+// finalArtifactState is the artifact state key that marks an artifact as
+// the final one of a chain, for run_on_final_only.
+const finalArtifactState = "final"
+
+// isFinalArtifact returns whether the artifact is the final one of a chain
+// of post-processors. Post-processors can't see the rest of the chain, so
+// this goes by the artifact's builder ID being one of final_builder_ids.
+// Neither Packer nor its plugins set the "final" state, but a plugin that
+// knows better can, and it takes precedence.
+func (p *PostProcessor) isFinalArtifact(artifact packer.Artifact) bool {
+	if final, ok := artifact.State(finalArtifactState).(bool); ok {
+		return final
+	}
+	return containsString(p.config.FinalBuilderIds, artifact.BuilderId())
+}
+
+// skipBuilder returns whether the only_builder_types and
+// except_builder_types filters exclude the builder that produced the
+// artifact.
+func (p *PostProcessor) skipBuilder() bool {
+	builderType := p.config.PackerBuilderType
+	if len(p.config.OnlyBuilderTypes) > 0 {
+		for _, b := range p.config.OnlyBuilderTypes {
+			if b == builderType {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, b := range p.config.ExceptBuilderTypes {
+		if b == builderType {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRun shows the commands that would be run for the artifact's files
+// and checks the templates depending on the artifact, without running
+// anything. The artifact is returned unchanged.
+func (p *PostProcessor) dryRun(ui packer.Ui, artifact packer.Artifact, scripts []script, files []string) (packer.Artifact, bool, error) {
+	if err := p.checkTemplates(artifact); err != nil {
+		return nil, false, err
+	}
+
+	if p.config.Archive != "" {
+		ui.Message(fmt.Sprintf("Would create %s archive: %s", p.config.Archive, p.config.ArchivePath))
+	}
+
+	for _, art := range p.targets(files) {
+		for _, s := range scripts {
+			cmd, err := p.command(s, art)
+			if err != nil {
+				return nil, false, err
+			}
+			ui.Message(fmt.Sprintf("Would run: %s", strings.Join(cmd.Args, " ")))
+		}
+	}
+
+	return artifact, true, nil
+}
+
+// posixShells are the interpreters whose scripts can be checked with -n.
+var posixShells = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"dash": true,
+	"ksh":  true,
+	"zsh":  true,
+}
+
+// checkSyntax parses each script with its shell's -n flag, without running
+// it. Inline scripts whose interpreter isn't a POSIX shell are skipped.
+func (p *PostProcessor) checkSyntax(ui packer.Ui, scripts []script) error {
+	errs := new(packer.MultiError)
+	for _, s := range scripts {
+		shell := p.shell(s)
+		if !posixShells[filepath.Base(shell)] {
+			ui.Message(fmt.Sprintf("Not checking syntax of %s, %s isn't a POSIX shell", s.name, shell))
+			continue
+		}
+
+		ui.Message(fmt.Sprintf("Checking syntax of %s", s.name))
+		var stderr bytes.Buffer
+		cmd := exec.Command(shell, "-n", s.path)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			errs = packer.MultiErrorAppend(errs,
+				fmt.Errorf("Syntax error in script %s: %s", s.name, stderr.String()))
+		}
+	}
+
+	if len(errs.Errors) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// runCleanupScript runs the cleanup script with the artifact files as its
+// arguments. Failures are only reported, so they don't hide the outcome of
+// the other scripts.
+func (p *PostProcessor) runCleanupScript(ui packer.Ui, env environment, workingDir string, files []string) {
+	ui.Say(fmt.Sprintf("Running cleanup script: %s", p.config.CleanupScript))
+
+	s := script{name: p.config.CleanupScript, path: p.config.CleanupScript}
+	cmd, err := p.command(s, files...)
+	if err != nil {
+		ui.Error(fmt.Sprintf("Warning: cleanup script failed: %s", err))
+		return
+	}
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Dir = workingDir
+	cmd.Env = env.with(
+		envWorkingDir+"="+cmd.Dir,
+		envShell+"="+p.shell(s),
+	).merge(p.config.EnvPrecedence, p.config.NormalizeEnvCase == "upper")
+	err = cmd.Run()
+	ui.Message(output.String())
+	if err != nil {
+		ui.Error(fmt.Sprintf("Warning: cleanup script failed: %s", err))
+	}
+}
+
+// checkAbortFile returns an error when abort_file exists. It is called
+// before every script is started.
+func (p *PostProcessor) checkAbortFile() error {
+	if p.config.AbortFile == "" {
+		return nil
+	}
+	if _, err := os.Stat(p.config.AbortFile); err == nil {
+		return fmt.Errorf("Aborting: abort file %s exists", p.config.AbortFile)
+	}
+	return nil
+}
+
+// runScriptsOnce runs each of the scripts a single time, in order, without
+// an artifact file argument, for pre_scripts and post_scripts. The first
+// failure stops the rest from running.
+func (p *PostProcessor) runScriptsOnce(ui packer.Ui, scripts []script, env environment, workingDir string, interrupt <-chan os.Signal) error {
+	for _, s := range scripts {
+		if err := p.checkAbortFile(); err != nil {
+			return err
+		}
+		ui.Say(fmt.Sprintf("Process with shell script: %s", s.name))
+
+		cmd, err := p.command(s)
+		if err != nil {
+			return err
+		}
+
+		stdout := limitedBuffer{limit: *p.config.MaxOutputBytes}
+		stderr := limitedBuffer{limit: *p.config.MaxOutputBytes}
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Dir = workingDir
+		cmd.Env = env.with(
+			envWorkingDir+"="+cmd.Dir,
+			envShell+"="+p.shell(s),
+		).merge(p.config.EnvPrecedence, p.config.NormalizeEnvCase == "upper")
+		err = runInterruptible(cmd, interrupt)
+		ui.Message(stdout.String())
+		p.lastOutput.Write(stdout.Bytes())
+		p.lastOutput.Write(stderr.Bytes())
+		if err != nil {
+			if _, ok := err.(*InterruptError); ok {
+				return err
+			}
+			exitCode := -1
+			if cmd.ProcessState != nil {
+				exitCode = cmd.ProcessState.ExitCode()
+			}
+			return &ScriptError{
+				Script:   s.name,
+				ExitCode: exitCode,
+				Signal:   exitSignal(err),
+				Stderr:   tailLines(stderr.String(), p.config.StderrTailLines),
+				Err:      err,
+			}
+		}
+	}
+	return nil
+}
+
+// captureVars returns vars, which holds "key=value" entries, updated with
+// the capture_vars values found in output.
+func (p *PostProcessor) captureVars(vars []string, output string) []string {
+	names := make([]string, 0, len(p.config.captureVars))
+	for name := range p.config.captureVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m := p.config.captureVars[name].FindStringSubmatch(output)
+		if m == nil {
+			continue
+		}
+		value := m[0]
+		if len(m) > 1 {
+			value = m[1]
+		}
+
+		updated := make([]string, 0, len(vars)+1)
+		for _, kv := range vars {
+			if !strings.HasPrefix(kv, name+"=") {
+				updated = append(updated, kv)
+			}
+		}
+		vars = append(updated, name+"="+value)
+	}
+	return vars
+}
+
+// writeOutputLog appends the command line and output of a script run
+// against the artifact file art to the file named by the output_log
+// template, creating it and its parent directories when needed.
+func (p *PostProcessor) writeOutputLog(art string, args []string, stdout string, stderr string) error {
+	name := ""
+	if art != "" {
+		name = filepath.Base(art)
+	}
+	p.config.ctx.Data = &OutputLogTemplate{
+		ArtifactName: name,
+		BuildName:    p.config.PackerBuildName,
+	}
+	path, err := interpolate.Render(p.config.OutputLog, &p.config.ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	var entry bytes.Buffer
+	fmt.Fprintf(&entry, "==> %s\n", strings.Join(args, " "))
+	fmt.Fprintf(&entry, "--- stdout\n%s", stdout)
+	fmt.Fprintf(&entry, "--- stderr\n%s", stderr)
+	if _, err := f.Write(entry.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hasVar returns whether the user set the named environment variable.
+func (p *PostProcessor) hasVar(key string) bool {
+	for _, kv := range p.config.Vars {
+		if strings.SplitN(kv, "=", 2)[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultMaxOutputBytes is the max_output_bytes used when it isn't set.
+const defaultMaxOutputBytes int64 = 10 * 1024 * 1024
+
+// daemonizeWaitDelay is how long, with allow_daemonize, output is still
+// read after a script exits.
+const daemonizeWaitDelay = time.Second
+
+// tracers are the commands, by OS, used to trace scripts with trace.
+var tracers = map[string][]string{
+	"darwin": {"dtruss", "-f"},
+	"linux":  {"strace", "-f"},
+}
+
+// shell returns the path of the interpreter that runs the script.
+func (p *PostProcessor) shell(s script) string {
+	shell := "/bin/sh"
+	if s.inline {
+		shell = p.inlineInterpreter()[0]
+	}
+	if path, err := exec.LookPath(shell); err == nil {
+		return path
+	}
+	return shell
+}
+
+// maxCPUs is one more than the highest CPU number cpu_affinity accepts.
+const maxCPUs = 1024
+
+// command returns the command that runs the script with the artifact
+// files as its arguments, skipping empty ones, followed by script_args.
+func (p *PostProcessor) command(s script, files ...string) (*exec.Cmd, error) {
+	var args []string
+	// taskset pins itself before running the rest of the command, so
+	// nothing the script starts escapes cpu_affinity.
+	if len(p.config.CPUAffinity) > 0 {
+		cpus := make([]string, len(p.config.CPUAffinity))
+		for i, cpu := range p.config.CPUAffinity {
+			cpus[i] = strconv.Itoa(cpu)
+		}
+		args = append(args, "taskset", "-c", strings.Join(cpus, ","))
+	}
+	if p.config.RunAs != "" {
+		p.config.ctx.Data = &SudoCommandTemplate{User: p.config.RunAs}
+		sudo, err := interpolate.Render(p.config.SudoCommand, &p.config.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Error rendering sudo_command template: %s", err)
+		}
+		args = append(args, strings.Fields(sudo)...)
+	}
+
+	if p.config.Trace {
+		args = append(args, tracers[runtime.GOOS]...)
+		if runtime.GOOS == "linux" {
+			args = append(args, "-A", "-o", p.config.TraceOutput)
+		}
+	}
+
+	// The inline script is run by the interpreter named in its
+	// shebang, everything else by the shell.
+	if s.inline {
+		args = append(args, p.inlineInterpreter()...)
+	} else {
+		args = append(args, p.shell(s))
+	}
+	args = append(args, s.path)
+	for _, file := range files {
+		if file != "" {
+			args = append(args, file)
+		}
+	}
+	args = append(args, p.config.ScriptArgs...)
+	return exec.Command(args[0], args[1:]...), nil
+}
+
+// targets returns the artifact files the scripts are run against. With
+// run_once each script is run a single time with no artifact file
+// argument, which is represented by an empty path.
+func (p *PostProcessor) targets(files []string) []string {
+	if p.config.RunOnce {
+		return []string{""}
+	}
+	if p.config.FileIndex != nil {
+		return files[*p.config.FileIndex : *p.config.FileIndex+1]
+	}
+	if len(p.config.Extensions) == 0 {
+		return files
+	}
+
+	targets := make([]string, 0, len(files))
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		for _, allowed := range p.config.Extensions {
+			if strings.EqualFold(ext, allowed) {
+				targets = append(targets, file)
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// walkFiles returns the paths of the regular files in dir and its
+// subdirectories, in lexical order.
+func walkFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// sortFiles returns a copy of files sorted by "name" or "size", smallest
+// first. Files of the same size are sorted by name.
+func sortFiles(files []string, by string) ([]string, error) {
+	sorted := make([]string, len(files))
+	copy(sorted, files)
+
+	sizes := make(map[string]int64)
+	if by == "size" {
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, err
+			}
+			sizes[file] = info.Size()
+		}
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sizes[sorted[i]] != sizes[sorted[j]] {
+			return sizes[sorted[i]] < sizes[sorted[j]]
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted, nil
+}
+
+// isRemoteArtifact returns whether the artifact file is an http(s) URL.
+func isRemoteArtifact(art string) bool {
+	u, err := url.Parse(art)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// downloadArtifact fetches the given URL into a new temporary file in dir
+// and returns the file's path.
+func downloadArtifact(rawurl string, dir string) (string, error) {
+	resp, err := http.Get(rawurl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+
+	ext := ""
+	if u, err := url.Parse(rawurl); err == nil {
+		ext = filepath.Ext(u.Path)
+	}
+
+	tf, err := ioutil.TempFile(dir, downloadPrefix+"*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer tf.Close()
+
+	if _, err := io.Copy(tf, resp.Body); err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+
+	return tf.Name(), nil
+}
+
+// providerForBuilderId maps the IDs of the builders shipped with Packer to
+// the name of the provider they build for.
+var providerForBuilderId = map[string]string{
+	"mitchellh.amazonebs":       "aws",
+	"mitchellh.amazon.instance": "aws",
+	"mitchellh.digitalocean":    "digitalocean",
+	"pearkes.digitalocean":      "digitalocean",
+	"packer.docker":             "docker",
+	"packer.googlecompute":      "google",
+	"MSOpenTech.hyperv":         "hyperv",
+	"packer.parallels":          "parallels",
+	"transcend.qemu":            "libvirt",
+	"mitchellh.virtualbox":      "virtualbox",
+	"mitchellh.vmware":          "vmware",
+	"mitchellh.vmware-esx":      "vmware",
+}
+
+// provider returns the name of the provider the artifact was built for.
+// The configured provider takes precedence over one set in the artifact's
+// state, which in turn takes precedence over detecting it from the builder.
+// Unknown builders fall back to the builder type.
+func (p *PostProcessor) provider(artifact packer.Artifact) string {
+	if p.config.Provider != "" {
+		return p.config.Provider
+	}
+	if name, ok := artifact.State("provider").(string); ok && name != "" {
+		return name
+	}
+	if name, ok := providerForBuilderId[artifact.BuilderId()]; ok {
+		return name
+	}
+	return p.config.PackerBuilderType
+}
+
+// placeArtifact moves, or copies when copyFiles is set, the given files of
+// the artifact into the directory described by the output_structure
+// template for provider and returns their new paths.
+func (p *PostProcessor) placeArtifact(ui packer.Ui, artifact packer.Artifact, provider string, files []string, copyFiles bool) ([]string, error) {
+	p.config.ctx.Data = &OutputPathTemplate{
+		ArtifactId: artifact.Id(),
+		BuildName:  p.config.PackerBuildName,
+		Provider:   provider,
+	}
+	dir, err := interpolate.Render(p.config.OutputStructure, &p.config.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Error rendering output_structure template: %s", err)
+	}
+
+	return p.placeFiles(ui, dir, files, copyFiles)
+}
+
+// composeArtifact turns newArtifact into a composite of the artifacts for
+// each provider in the provider list. With output_structure each provider
+// is given its own copy of the files, and their paths are listed by
+// provider in the "provider_files" state. The copies are removed when
+// newArtifact is destroyed.
+func (p *PostProcessor) composeArtifact(ui packer.Ui, artifact packer.Artifact, newArtifact *Artifact) error {
+	providerFiles := make(map[string][]string, len(p.config.providers))
+	var files []string
+	for i, provider := range p.config.providers {
+		placed := newArtifact.files
+		if p.config.OutputStructure != "" {
+			// The files are copied for every provider but the last, which
+			// they are moved for.
+			var err error
+			copied := i < len(p.config.providers)-1
+			placed, err = p.placeArtifact(ui, artifact, provider, newArtifact.files, copied)
+			if err != nil {
+				return err
+			}
+			if copied {
+				newArtifact.aux = append(newArtifact.aux, placed...)
+			}
+			files = append(files, placed...)
+		}
+		providerFiles[provider] = placed
+	}
+
+	if p.config.OutputStructure != "" {
+		newArtifact.files = files
+	}
+	newArtifact.id = strings.Join(p.config.providers, ",")
+	newArtifact.str = fmt.Sprintf("%s for providers %s", newArtifact.str, strings.Join(p.config.providers, ", "))
+	newArtifact.state["provider_files"] = providerFiles
+	return nil
+}
+
+// renderTarget returns the target directory for the artifact. Fields of
+// OutputPathTemplate that are empty can't be used, since they would
+// silently change the directory's path.
+func (p *PostProcessor) renderTarget(artifact packer.Artifact) (string, error) {
+	data := &OutputPathTemplate{
+		ArtifactId: artifact.Id(),
+		BuildName:  p.config.PackerBuildName,
+		Provider:   p.provider(artifact),
+	}
+	for _, field := range [][2]string{
+		{"ArtifactId", data.ArtifactId},
+		{"BuildName", data.BuildName},
+		{"Provider", data.Provider},
+	} {
+		if field[1] == "" && strings.Contains(p.config.TargetPath, "."+field[0]) {
+			return "", fmt.Errorf("target refers to {{.%s}}, which is empty for artifact %s", field[0], artifact.Id())
+		}
+	}
+
+	p.config.ctx.Data = data
+	dir, err := interpolate.Render(p.config.TargetPath, &p.config.ctx)
+	if err != nil {
+		return "", fmt.Errorf("Error rendering target template: %s", err)
+	}
+	if dir == "" {
+		return "", errors.New("target rendered to an empty path")
+	}
+	return dir, nil
+}
+
+// copyArtifact copies the artifact files into the target directory, for
+// mode "copy", and returns an artifact listing the copies, which are
+// removed when it is destroyed.
+func (p *PostProcessor) copyArtifact(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	dir, err := p.renderTarget(artifact)
+	if err != nil {
+		return nil, false, err
+	}
+
+	files, err := p.placeFiles(ui, dir, artifact.Files(), true)
+	if err != nil {
+		return nil, false, err
+	}
+
+	newArtifact := NewArtifact(artifact)
+	newArtifact.files = files
+	newArtifact.aux = files
+	ui.Say(fmt.Sprintf("Returning new artifact %s with files %s", newArtifact.BuilderId(), newArtifact.Files()))
+	return newArtifact, true, nil
+}
+
+// placeFiles moves files, or copies them when copyFiles is set, into dir,
+// creating it if needed, and returns their new paths. Their checksum
+// sidecars are placed along with them.
+func (p *PostProcessor) placeFiles(ui packer.Ui, dir string, files []string, copyFiles bool) ([]string, error) {
+	if err := os.MkdirAll(dir, p.config.targetDirMode); err != nil {
+		return nil, fmt.Errorf("Error creating output directory %s: %s", dir, err)
+	}
+	// MkdirAll's permissions are masked by the umask, so set them
+	// explicitly when they were asked for.
+	if p.config.RawTargetDirMode != "" {
+		if err := os.Chmod(dir, p.config.targetDirMode); err != nil {
+			return nil, fmt.Errorf("Error setting permissions of %s: %s", dir, err)
+		}
+	}
+
+	// Everything placed so far, sidecars included, for finalize to roll
+	// back.
+	var from, to []string
+	placed := make([]string, 0, len(files))
+	for _, file := range files {
+		srcs := []string{file}
+		sidecar, hasSidecar := p.sidecars[file]
+		if hasSidecar {
+			srcs = append(srcs, sidecar)
+		}
+
+		for _, src := range srcs {
+			dst := filepath.Join(dir, filepath.Base(src))
+			err := p.placeFile(ui, src, dst, copyFiles)
+			if err == nil {
+				from = append(from, src)
+				to = append(to, dst)
+				if p.config.targetFileMode != 0 {
+					if chmodErr := os.Chmod(dst, p.config.targetFileMode); chmodErr != nil {
+						err = fmt.Errorf("Error setting permissions of %s: %s", dst, chmodErr)
+					}
+				}
+			}
+
+			if err != nil {
+				if p.config.Finalize {
+					rollbackPlacement(ui, from, to, copyFiles)
+				}
+				return nil, err
+			}
+		}
+
+		dst := filepath.Join(dir, filepath.Base(file))
+		placed = append(placed, dst)
+		if hasSidecar {
+			p.sidecars[dst] = filepath.Join(dir, filepath.Base(sidecar))
+			if !copyFiles {
+				delete(p.sidecars, file)
+			}
+		}
+	}
+
+	return placed, nil
+}
+
+// placeFile moves src to dst, or copies it when copyFiles is set.
+func (p *PostProcessor) placeFile(ui packer.Ui, src, dst string, copyFiles bool) error {
+	if copyFiles {
+		ui.Message(fmt.Sprintf("Copying %s to %s", src, dst))
+		if err := copyFile(src, dst); err != nil {
+			return fmt.Errorf("Error copying %s to %s: %s", src, dst, err)
+		}
+		return nil
+	}
+
+	ui.Message(fmt.Sprintf("Moving %s to %s", src, dst))
+	// With finalize only an atomic rename will do, so there is no falling
+	// back to copying across filesystems.
+	move := moveFile
+	if p.config.Finalize {
+		move = os.Rename
+	}
+	if err := move(src, dst); err != nil {
+		return fmt.Errorf("Error moving %s to %s: %s", src, dst, err)
+	}
+	return nil
+}
+
+// rollbackPlacement undoes placeFiles having placed each of files at the
+// same index in placed, for finalize, by removing copies or moving files
+// back.
+func rollbackPlacement(ui packer.Ui, files []string, placed []string, copied bool) {
+	for i := len(placed) - 1; i >= 0; i-- {
+		var err error
+		if copied {
+			err = os.Remove(placed[i])
+		} else {
+			err = os.Rename(placed[i], files[i])
+		}
+		if err != nil {
+			ui.Error(fmt.Sprintf("Error rolling back placement of %s: %s", files[i], err))
+		}
+	}
+}
+
+// moveFile renames src to dst, falling back to copying and removing src
+// when they are on different filesystems.
+func moveFile(src, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies the contents and mode of src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	// The mode given to OpenFile is masked by the umask and ignored when
+	// dst already exists.
+	return os.Chmod(dst, info.Mode())
+}
+
+// LastOutput returns the stdout and stderr of every script run by the
+// most recent call to PostProcess, up to max_output_bytes in all, for
+// callers embedding the post-processor.
+func (p *PostProcessor) LastOutput() string {
+	return p.lastOutput.String()
+}
+
+func (p *PostProcessor) PostProcess(ui packer.Ui, artifact packer.Artifact) (packer.Artifact, bool, error) {
+	if p.skipBuilder() {
+		ui.Say(fmt.Sprintf("Skipping artifact from builder type: %s", p.config.PackerBuilderType))
+		switch p.config.SkipReturns {
+		case "empty":
+			empty := NewArtifact(artifact)
+			empty.files = []string{}
+			return empty, true, nil
+		case "error":
+			return nil, false, fmt.Errorf("Builder type %s is excluded by only_builder_types or except_builder_types", p.config.PackerBuilderType)
+		default:
+			return artifact, true, nil
+		}
+	}
+
+	if p.config.RunOnFinalOnly && !p.isFinalArtifact(artifact) {
+		ui.Say(fmt.Sprintf("Skipping artifact %s, which isn't the final one of the chain", artifact.Id()))
+		return artifact, true, nil
+	}
+
+	startTime := time.Now().UTC()
+	p.lastOutput = limitedBuffer{limit: *p.config.MaxOutputBytes}
+	p.sidecars = make(map[string]string)
+
+	for _, warning := range p.warnings {
+		ui.Say(fmt.Sprintf("Warning: %s", warning))
+	}
+
+	if p.config.Mode == "copy" {
+		return p.copyArtifact(ui, artifact)
+	}
+
+	// Scripts run in their own process group, so a Ctrl-C of the build
+	// no longer reaches them directly; forward it here instead. Catching
+	// the signals from the start also means a SIGTERM stops the next
+	// script rather than the plugin, so the temporary files below are
+	// still removed by their deferred cleanup, which also runs on panic.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	if !p.config.KeepTempScript {
+		sweepTempFiles(p.config.TempDir)
+	}
+
+	p.config.ctx.Data = p.scriptTemplate(artifact)
+
+	// Each script is read and prepared once, no matter how many times it
+	// is listed or how many artifact files it is run against.
+	prepared := make(map[string]script)
+	defer func() {
+		for _, s := range prepared {
+			if s.path != s.name {
+				os.Remove(s.path)
+			}
+		}
+	}()
+	prepare := func(paths []string, extra int) ([]script, error) {
+		list := make([]script, 0, len(paths)+extra)
+		for _, path := range paths {
+			s, ok := prepared[path]
+			if !ok {
+				var err error
+				s, err = p.prepareScript(path)
+				if err != nil {
+					return nil, fmt.Errorf("Error preparing shell script %s: %s", path, err)
+				}
+				prepared[path] = s
+			}
+			list = append(list, s)
+		}
+		return list, nil
+	}
+	scripts, err := prepare(p.config.Scripts, 1)
+	if err != nil {
+		return nil, false, err
+	}
+	preScripts, err := prepare(p.config.PreScripts, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	postScripts, err := prepare(p.config.PostScripts, 0)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if p.hasInline() {
+		tf, err := ioutil.TempFile(p.config.TempDir, p.tempScriptPrefix()+"*"+p.config.InlineExtension)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+		}
+		if p.config.KeepTempScript {
+			ui.Say(fmt.Sprintf("Keeping inline script: %s", tf.Name()))
+		} else {
+			defer os.Remove(tf.Name())
+		}
+
+		// Set the path to the temporary file
+		scripts = append(scripts, script{name: tf.Name(), path: tf.Name(), inline: true})
+
+		// Write our contents to it
+		writer := bufio.NewWriter(tf)
+		writer.WriteString(p.inlineShebangLine())
+		if p.config.InlineBase64 != "" {
+			contents, err := base64.StdEncoding.DecodeString(p.config.InlineBase64)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error decoding inline_base64: %s", err)
+			}
+			if _, err := writer.Write(contents); err != nil {
+				return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+			}
+		}
+		for _, command := range p.config.Inline {
+			if _, err := writer.WriteString(command + p.config.InlineSeparator); err != nil {
+				return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+			}
+		}
+
+		if err := writer.Flush(); err != nil {
+			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+		}
+
+		tf.Close()
+		if err := p.shareWithRunAs(tf.Name(), 0644); err != nil {
+			return nil, false, fmt.Errorf("Error preparing shell script: %s", err)
+		}
+	}
+
+	if len(p.config.InlineScripts) > 0 {
+		dir, err := ioutil.TempDir(p.config.TempDir, p.tempScriptPrefix())
+		if err != nil {
+			return nil, false, fmt.Errorf("Error preparing inline_scripts: %s", err)
+		}
+		if p.config.KeepTempScript {
+			ui.Say(fmt.Sprintf("Keeping inline_scripts in: %s", dir))
+		} else {
+			defer os.RemoveAll(dir)
+		}
+		if err := p.shareWithRunAs(dir, 0755); err != nil {
+			return nil, false, fmt.Errorf("Error preparing inline_scripts: %s", err)
+		}
+
+		names := make([]string, 0, len(p.config.InlineScripts))
+		for name := range p.config.InlineScripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			path := filepath.Join(dir, name)
+			contents := p.inlineShebangLine() + p.config.InlineScripts[name]
+			if err := ioutil.WriteFile(path, []byte(contents), 0700); err != nil {
+				return nil, false, fmt.Errorf("Error preparing inline script %s: %s", name, err)
+			}
+			if err := p.shareWithRunAs(path, 0755); err != nil {
+				return nil, false, fmt.Errorf("Error preparing inline script %s: %s", name, err)
+			}
+			scripts = append(scripts, script{name: name, path: path, inline: true})
+		}
+	}
+
+	// Configure should have ensured there is something to run, but don't
+	// hand back an artifact that was never processed if it didn't.
+	if len(scripts) == 0 {
+		return nil, false, errors.New("Internal error: no scripts to run; was Configure called?")
+	}
+
+	env := environment{user: p.config.Vars}
+	env = env.with(envBuildTimestamp + "=" + startTime.Format(time.RFC3339))
+
+	shellConfig, err := effectiveConfig(&p.config)
+	if err != nil {
+		return nil, false, fmt.Errorf("Error encoding config: %s", err)
+	}
+	env = env.with(envShellConfig + "=" + shellConfig)
+
+	// The counter is only incremented once the scripts are about to run;
+	// until then, and for dry runs, the number is a placeholder.
+	if p.config.SequenceFile != "" {
+		env = env.with(envRunSeq + "=" + dryRunSequence)
+	}
+	for _, kv := range [][2]string{
+		{envBuildName, p.config.PackerBuildName},
+		{envBuilderType, p.config.PackerBuilderType},
+	} {
+		// With override_packer_vars the user's value is used instead.
+		if p.config.OverridePackerVars && p.hasVar(kv[0]) {
+			continue
+		}
+		env = env.with(kv[0] + "=" + kv[1])
+	}
+	// Without the host environment scripts would have no PATH, and fail
+	// to find even standard commands.
+	if !containsString(p.config.EnvPrecedence, envInherited) && !p.hasVar("PATH") {
+		env = env.with("PATH=" + p.config.MinimalPath)
+	}
+	if p.config.ExpandHostEnv {
+		env.user = make([]string, len(p.config.Vars))
+		for i, kv := range p.config.Vars {
+			vs := strings.SplitN(kv, "=", 2)
+			env.user[i] = vs[0] + "=" + os.ExpandEnv(vs[1])
+		}
+	}
+
+	// Forward the host's SSH agent unless the user set the socket
+	// themselves.
+	if p.config.ForwardSSHAgent && !p.hasVar("SSH_AUTH_SOCK") {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			env = env.with("SSH_AUTH_SOCK=" + sock)
+		} else {
+			ui.Message("Not forwarding SSH agent: SSH_AUTH_SOCK is not set")
+		}
+	}
+
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return nil, false, fmt.Errorf("Error determining working directory: %s", err)
+	}
+
+	ui.Say(fmt.Sprintf("Processing artifact from: %s", artifact.BuilderId()))
+	files := artifact.Files()
+	ui.Message(fmt.Sprintf("Artifact has %d file(s)", len(files)))
+	if p.config.RequireFiles && len(files) == 0 {
+		return nil, false, errors.New("Artifact has no files and require_files is set")
+	}
+	if p.config.DownloadRemoteArtifacts {
+		files = make([]string, len(artifact.Files()))
+		for i, art := range artifact.Files() {
+			if !isRemoteArtifact(art) {
+				files[i] = art
+				continue
+			}
+
+			ui.Message(fmt.Sprintf("Downloading remote artifact: %s", art))
+			path, err := downloadArtifact(art, p.config.TempDir)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error downloading artifact %s: %s", art, err)
+			}
+			defer os.Remove(path)
+			files[i] = path
+		}
+	}
+	if p.config.RecurseDirectory && len(files) == 1 {
+		if info, err := os.Stat(files[0]); err == nil && info.IsDir() {
+			dirFiles, err := walkFiles(files[0])
+			if err != nil {
+				return nil, false, fmt.Errorf("Error reading artifact directory %s: %s", files[0], err)
+			}
+			ui.Message(fmt.Sprintf("Found %d file(s) in artifact directory %s", len(dirFiles), files[0]))
+			files = dirFiles
+		}
+	}
+	if p.config.SortFiles != "none" {
+		sorted, err := sortFiles(files, p.config.SortFiles)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error sorting artifact files: %s", err)
+		}
+		files = sorted
+	}
+	if p.config.MaxArtifactSizeBytes > 0 {
+		for _, file := range files {
+			if isRemoteArtifact(file) {
+				continue
+			}
+			info, err := os.Stat(file)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error checking size of %s: %s", file, err)
+			}
+			if !info.IsDir() && info.Size() > p.config.MaxArtifactSizeBytes {
+				return nil, false, fmt.Errorf("Artifact file %s is %d bytes, larger than max_artifact_size_bytes of %d",
+					file, info.Size(), p.config.MaxArtifactSizeBytes)
+			}
+		}
+	}
+	// Files the post-processor generates alongside the artifact, which are
+	// removed along with it.
+	var auxFiles []string
+	// The scripts are run against the archive, which isn't created until
+	// we know they will be.
+	archived := files
+	if p.config.Archive != "" {
+		files = []string{p.config.ArchivePath}
+	}
+
+	if p.config.FileIndex != nil && *p.config.FileIndex >= len(files) {
+		return nil, false, fmt.Errorf("file_index %d is out of range for an artifact with %d file(s)",
+			*p.config.FileIndex, len(files))
+	}
+
+	env = env.with(envTotalArtifactFiles + "=" + strconv.Itoa(len(files)))
+
+	if p.config.WriteVarsFile {
+		path, err := p.writeVarsFile(artifact, files)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error writing vars file: %s", err)
+		}
+		defer os.Remove(path)
+		env = env.with(envVarsFile + "=" + path)
+	}
+
+	// Scripts may replace the artifact's files by listing the new ones in
+	// the output manifest, which doesn't exist until a script writes it.
+	manifestDir, err := ioutil.TempDir(p.config.TempDir, tempPrefix+"manifest-")
+	if err != nil {
+		return nil, false, fmt.Errorf("Error creating output manifest directory: %s", err)
+	}
+	defer os.RemoveAll(manifestDir)
+	// Without being able to write the directory, scripts run as run_as
+	// couldn't create the manifest. Nobody else may, or they could replace
+	// the artifact's files.
+	if err := p.shareWithRunAs(manifestDir, 0770); err != nil {
+		return nil, false, fmt.Errorf("Error creating output manifest directory: %s", err)
+	}
+	manifestPath := filepath.Join(manifestDir, "manifest")
+	env = env.with(envOutputManifest + "=" + manifestPath)
+
+	if p.config.ValidateOnly {
+		if err := p.checkSyntax(ui, scripts); err != nil {
+			return nil, false, err
+		}
+		return p.dryRun(ui, artifact, scripts, files)
+	}
+
+	if p.config.DryRun {
+		return p.dryRun(ui, artifact, scripts, files)
+	}
+
+	if p.config.IdempotencyCheck != "" {
+		ui.Message("Running idempotency check")
+		var output bytes.Buffer
+		// The check is run before the archive is created, so that it isn't
+		// left behind when the work is already done, and is given the
+		// files that would go in it.
+		cmd := exec.Command("/bin/sh", append([]string{"-c", p.config.IdempotencyCheck, "sh"}, archived...)...)
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		cmd.Dir = workingDir
+		cmd.Env = env.merge(p.config.EnvPrecedence, p.config.NormalizeEnvCase == "upper")
+		err := cmd.Run()
+		if output.Len() > 0 {
+			ui.Message(output.String())
+		}
+		if err == nil {
+			ui.Say(fmt.Sprintf("Idempotency check passed, returning artifact %s without running scripts", artifact.Id()))
+			return artifact, true, nil
+		}
+		if _, ok := err.(*exec.ExitError); !ok {
+			return nil, false, fmt.Errorf("Error running idempotency check: %s", err)
+		}
+	}
+
+	if p.config.Archive != "" {
+		ui.Message(fmt.Sprintf("Creating %s archive: %s", p.config.Archive, p.config.ArchivePath))
+		if err := createArchive(p.config.Archive, p.config.ArchivePath, archived); err != nil {
+			return nil, false, fmt.Errorf("Error creating archive %s: %s", p.config.ArchivePath, err)
+		}
+		auxFiles = append(auxFiles, p.config.ArchivePath)
+	}
+
+	if p.config.SequenceFile != "" {
+		seq, err := nextSequence(p.config.SequenceFile)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error updating sequence_file: %s", err)
+		}
+		env = env.with(envRunSeq + "=" + strconv.Itoa(seq))
+	}
+
+	if p.config.CleanupScript != "" {
+		defer p.runCleanupScript(ui, env, workingDir, files)
+	}
+
+	// strace appends each script's trace to the output file itself, while
+	// dtruss writes its trace to stderr, which is copied there.
+	var traceFile *os.File
+	if p.config.Trace {
+		traceFile, err = os.Create(p.config.TraceOutput)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error creating trace output: %s", err)
+		}
+		defer traceFile.Close()
+		ui.Message(fmt.Sprintf("Tracing scripts to: %s", p.config.TraceOutput))
+	}
+
+	// Output past max_output_bytes is dropped rather than kept in memory.
+	stderr := limitedBuffer{limit: *p.config.MaxOutputBytes}
+	stdout := limitedBuffer{limit: *p.config.MaxOutputBytes}
+	scriptErrs := new(packer.MultiError)
+	exitCode := 0
+	lastStdout := ""
+	var captured []string
+	if p.config.Debug {
+		log.Printf("Processing artifact: %+v", artifact)
+	}
+
+	// The results are written however the scripts finish, including when
+	// one fails.
+	var results []ScriptResult
+	if p.config.ResultFile != "" {
+		defer func() {
+			if err := writeResultFile(p.config.ResultFile, results); err != nil {
+				ui.Error(fmt.Sprintf("Error writing result_file: %s", err))
+			}
+		}()
+	}
+
+	onceEnv := env.with(envArtifactFiles + "=" + strings.Join(files, "\n"))
+	if err := p.runScriptsOnce(ui, preScripts, onceEnv, workingDir, interrupt); err != nil {
+		return nil, false, err
+	}
+
+	targets := p.targets(files)
+	for i, art := range targets {
+		if *p.config.ShowProgress && art != "" {
+			ui.Say(fmt.Sprintf("Processing file %d of %d: %s", i+1, len(targets), art))
+		}
+
+		// With chdir_to_artifact the scripts are run in the directory
+		// holding the file, so they get its absolute path.
+		dir := workingDir
+		if p.config.ChdirToArtifact && art != "" {
+			abs, err := filepath.Abs(art)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error resolving path of %s: %s", art, err)
+			}
+			art = abs
+			dir = filepath.Dir(abs)
+		}
+
+		fileEnv := env
+		if art != "" {
+			fileEnv = fileEnv.with(
+				envArtifactFileCount+"="+strconv.Itoa(len(targets)),
+				envArtifactFileIndex+"="+strconv.Itoa(i),
+			)
+		}
+		if p.config.ComputeChecksum != "none" {
+			sum, err := checksumFile(p.config.ComputeChecksum, art)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error computing checksum of %s: %s", art, err)
+			}
+			fileEnv = fileEnv.with(envArtifactChecksum + "=" + sum)
+
+			if p.config.ChecksumSidecar {
+				sidecar, err := writeChecksumSidecar(p.config.ComputeChecksum, art, sum)
+				if err != nil {
+					return nil, false, fmt.Errorf("Error writing checksum of %s: %s", art, err)
+				}
+				ui.Message(fmt.Sprintf("Wrote checksum: %s", sidecar))
+				p.sidecars[targets[i]] = sidecar
+			}
+		}
+
+		if p.config.PrecheckCommand != "" && art != "" {
+			ui.Message(fmt.Sprintf("Running precheck against artifact: %s", art))
+			stdout.Reset()
+			stderr.Reset()
+			cmd := exec.Command("/bin/sh", "-c", p.config.PrecheckCommand, "sh", art)
+			cmd.Stdout = &stdout
+			cmd.Stderr = &stderr
+			cmd.Dir = dir
+			cmd.Env = fileEnv.merge(p.config.EnvPrecedence, p.config.NormalizeEnvCase == "upper")
+			if err := cmd.Run(); err != nil {
+				return nil, false, fmt.Errorf("Precheck failed for artifact %s: %s: %s",
+					art, err, stderr.String())
+			}
+		}
+
+		var before []byte
+		if p.config.EmitDiff && art != "" {
+			contents, err := ioutil.ReadFile(art)
+			if err != nil {
+				return nil, false, fmt.Errorf("Error reading %s: %s", art, err)
+			}
+			if isText(contents) {
+				before = contents
+			} else {
+				ui.Message(fmt.Sprintf("Not diffing binary file: %s", art))
+			}
+		}
+
+		for _, s := range scripts {
+			if p.config.pauseBefore > 0 {
+				ui.Say(fmt.Sprintf("Pausing %s before running script...", p.config.pauseBefore))
+				sleep(p.config.pauseBefore)
+			}
+
+			ui.Say(fmt.Sprintf("Process with shell script: %s", s.name))
+
+			if art != "" {
+				ui.Message(fmt.Sprintf("Executing script with artifact: %s", art))
+			}
+			var cmdArgs []string
+			scriptStart := time.Now()
+			for attempt := 0; ; attempt++ {
+				if err := p.checkAbortFile(); err != nil {
+					return nil, false, err
+				}
+				stderr.Reset()
+				stdout.Reset()
+				var cmd *exec.Cmd
+				cmd, err = p.command(s, art)
+				if err != nil {
+					return nil, false, err
+				}
+				cmdArgs = cmd.Args
+				cmd.Stdout = &stdout
+				cmd.Stderr = &stderr
+				if p.config.CaptureCombined {
+					// Interleave both streams in the order they are written.
+					cmd.Stderr = &stdout
+				}
+				if p.config.Trace && runtime.GOOS == "darwin" {
+					cmd.Stderr = io.MultiWriter(cmd.Stderr, traceFile)
+				}
+				cmd.Dir = dir
+				cmd.Env = fileEnv.withUser(p.config.scriptEnvs[s.name]...).with(captured...).with(
+					envWorkingDir+"="+cmd.Dir,
+					envShell+"="+p.shell(s),
+				).merge(p.config.EnvPrecedence, p.config.NormalizeEnvCase == "upper")
+				// The artifact file is opened for each run so that every
+				// script reads it from the start. ExtraFiles[0] is fd 3.
+				var artifactFile *os.File
+				if p.config.PassArtifactFd && art != "" {
+					artifactFile, err = os.Open(art)
+					if err != nil {
+						return nil, false, fmt.Errorf("Error opening artifact %s: %s", art, err)
+					}
+					cmd.ExtraFiles = []*os.File{artifactFile}
+					cmd.Env = append(cmd.Env, envArtifactFd+"=3")
+				}
+				var watcher *stderrWatcher
+				if p.config.FailOnFirstStderr {
+					watcher = &stderrWatcher{w: cmd.Stderr, cmd: cmd}
+					cmd.Stderr = watcher
+				}
+				if p.config.AllowDaemonize {
+					// Processes the script left running in the background
+					// keep its output open, so stop reading once it exits.
+					cmd.WaitDelay = daemonizeWaitDelay
+				}
+				err = runInterruptible(cmd, interrupt)
+				if errors.Is(err, exec.ErrWaitDelay) {
+					err = nil
+				}
+				if artifactFile != nil {
+					artifactFile.Close()
+				}
+				if _, ok := err.(*InterruptError); ok {
+					return nil, false, err
+				}
+				if watcher != nil && watcher.triggered {
+					err = errors.New("script wrote to stderr")
+				}
+				exitCode = -1
+				if cmd.ProcessState != nil {
+					exitCode = cmd.ProcessState.ExitCode()
+				}
+				if err == nil || attempt >= len(p.config.retrySchedule) {
+					break
+				}
+
+				delay := p.config.retrySchedule[attempt]
+				ui.Say(fmt.Sprintf("Script %s failed, retrying in %s (attempt %d of %d)...",
+					s.name, delay, attempt+2, len(p.config.retrySchedule)+1))
+				sleep(delay)
+			}
+			ui.Message(fmt.Sprintf("%s", stdout.String()))
+			lastStdout = stdout.String()
+			captured = p.captureVars(captured, lastStdout)
+			results = append(results, ScriptResult{
+				Script:          s.name,
+				File:            art,
+				ExitCode:        exitCode,
+				DurationSeconds: time.Since(scriptStart).Seconds(),
+				Success:         err == nil,
+			})
+			p.lastOutput.Write(stdout.Bytes())
+			p.lastOutput.Write(stderr.Bytes())
+			if p.config.OutputLog != "" {
+				if logErr := p.writeOutputLog(art, cmdArgs, stdout.String(), stderr.String()); logErr != nil {
+					return nil, false, fmt.Errorf("Error writing output_log: %s", logErr)
+				}
+			}
+			if err != nil {
+				output := stderr.String()
+				if p.config.CaptureCombined {
+					output = stdout.String()
+				}
+				err = &ScriptError{
+					Script:   s.name,
+					File:     art,
+					ExitCode: exitCode,
+					Signal:   exitSignal(err),
+					Stderr:   tailLines(output, p.config.StderrTailLines),
+					Err:      err,
+				}
+				if !p.config.ContinueOnError {
+					return nil, false, err
+				}
+
+				ui.Error(err.Error())
+				scriptErrs = packer.MultiErrorAppend(scriptErrs, err)
+			}
+		}
+
+		if before != nil {
+			if after, err := ioutil.ReadFile(art); err != nil {
+				ui.Message(fmt.Sprintf("Unable to diff %s: %s", art, err))
+			} else if diff := unifiedDiff(art, before, after); diff != "" {
+				ui.Message(diff)
+			} else {
+				ui.Message(fmt.Sprintf("No changes to %s", art))
+			}
+		}
+	}
+
+	if err := p.runScriptsOnce(ui, postScripts, onceEnv, workingDir, interrupt); err != nil {
+		return nil, false, err
+	}
+
+	if p.config.produceIfOutput != nil && !p.config.produceIfOutput.MatchString(lastStdout) {
+		// Failures collected with continue_on_error still fail the build
+		// when no new artifact is produced.
+		if len(scriptErrs.Errors) > 0 && *p.config.FailOnAnyError {
+			return artifact, true, scriptErrs
+		}
+		ui.Say(fmt.Sprintf("Output of the last script does not match produce_if_output, returning artifact %s unchanged",
+			artifact.Id()))
+		return artifact, true, nil
+	}
+
+	newArtifact := NewArtifact(artifact)
+	newArtifact.aux = auxFiles
+	if p.config.Archive != "" {
+		newArtifact.files = files
+	}
+	for _, key := range p.config.PassthroughState {
+		if value := artifact.State(key); value != nil {
+			newArtifact.state[key] = value
+		}
+	}
+	newArtifact.state["exit_code"] = exitCode
+
+	manifestFiles, err := readOutputManifest(manifestPath)
+	if err != nil {
+		return nil, false, fmt.Errorf("Error reading output manifest: %s", err)
+	}
+	if manifestFiles != nil {
+		ui.Message(fmt.Sprintf("Found %d file(s) in the output manifest", len(manifestFiles)))
+		newArtifact.files = manifestFiles
+	}
+
+	if p.config.OutputFiles != "" {
+		outputs, err := filepath.Glob(p.config.OutputFiles)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error matching output_files: %s", err)
+		}
+		ui.Message(fmt.Sprintf("Found %d output file(s) matching %s", len(outputs), p.config.OutputFiles))
+		newArtifact.files = outputs
+	}
+
+	if len(p.config.providers) > 0 {
+		if err := p.composeArtifact(ui, artifact, newArtifact); err != nil {
+			return nil, false, err
+		}
+	} else if p.config.OutputStructure != "" {
+		placed, err := p.placeArtifact(ui, artifact, p.provider(artifact), newArtifact.files, false)
+		if err != nil {
+			return nil, false, err
+		}
+		newArtifact.files = placed
+	}
+
+	// The checksum sidecars are only tracked once they have been placed.
+	sidecars := make([]string, 0, len(p.sidecars))
+	for _, sidecar := range p.sidecars {
+		sidecars = append(sidecars, sidecar)
+	}
+	sort.Strings(sidecars)
+	newArtifact.aux = append(newArtifact.aux, sidecars...)
+
+	// With continue_on_error the artifact is returned alongside the
+	// collected failures so that partial results still propagate.
+	if len(scriptErrs.Errors) > 0 {
+		if *p.config.FailOnAnyError {
+			return newArtifact, true, scriptErrs
+		}
+
+		ui.Say(fmt.Sprintf("Ignoring %d script failure(s) because fail_on_any_error is false",
+			len(scriptErrs.Errors)))
+	}
+
 	ui.Say(fmt.Sprintf("Returning new artifact %s with files %s", newArtifact.BuilderId(), newArtifact.Files()))
 	return newArtifact, true, nil
 }
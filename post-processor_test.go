@@ -0,0 +1,2387 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/packer/packer"
+)
+
+// testUi is a packer.Ui that records everything shown to the user.
+type testUi struct {
+	out bytes.Buffer
+}
+
+func (u *testUi) Ask(string) (string, error) { return "", nil }
+func (u *testUi) Say(message string)         { u.out.WriteString(message + "\n") }
+func (u *testUi) Message(message string)     { u.out.WriteString(message + "\n") }
+func (u *testUi) Error(message string)       { u.out.WriteString(message + "\n") }
+func (u *testUi) Machine(string, ...string)  {}
+
+// testArtifact returns an artifact from a test builder with the given
+// files.
+func testArtifact(files ...string) *Artifact {
+	return &Artifact{
+		builderId: "test.builder",
+		files:     files,
+		id:        "test-artifact",
+		str:       "test artifact",
+		state:     make(map[string]interface{}),
+	}
+}
+
+// testPostProcessor returns a post-processor configured with raw, failing
+// the test if Configure does.
+func testPostProcessor(t *testing.T, raw map[string]interface{}) *PostProcessor {
+	t.Helper()
+	p := new(PostProcessor)
+	if err := p.Configure(raw); err != nil {
+		t.Fatalf("Configure: %s", err)
+	}
+	return p
+}
+
+// writeFile writes contents to name in dir, creating dir if needed, and
+// returns the file's path.
+func writeFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readFile returns the contents of path, failing the test if it can't be
+// read.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// recordSleeps replaces sleep for the rest of the test with one that
+// records the delays instead of waiting for them.
+func recordSleeps(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	t.Cleanup(func() { sleep = time.Sleep })
+	return &delays
+}
+
+func TestPostProcessor_ImplementsPostProcessor(t *testing.T) {
+	var _ packer.PostProcessor = new(PostProcessor)
+}
+
+func TestPostProcessorConfigure_TildeScripts(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := writeFile(t, filepath.Join(home, "scripts"), "foo.sh", "echo ran\n")
+
+	for _, key := range []string{"script", "scripts"} {
+		t.Run(key, func(t *testing.T) {
+			var value interface{} = "~/scripts/foo.sh"
+			if key == "scripts" {
+				value = []string{"~/scripts/foo.sh"}
+			}
+			p := testPostProcessor(t, map[string]interface{}{key: value})
+			if len(p.config.Scripts) != 1 || p.config.Scripts[0] != path {
+				t.Fatalf("expected scripts [%s], got %v", path, p.config.Scripts)
+			}
+
+			ui := new(testUi)
+			image := writeFile(t, t.TempDir(), "image", "")
+			if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+				t.Fatalf("PostProcess: %s", err)
+			}
+			if !strings.Contains(ui.out.String(), "ran") {
+				t.Fatalf("expected the script to run, got output:\n%s", ui.out.String())
+			}
+		})
+	}
+}
+
+func TestPostProcessorConfigure_TildeCleanupScript(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := writeFile(t, home, "cleanup.sh", "true\n")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":         []string{"true"},
+		"cleanup_script": "~/cleanup.sh",
+	})
+	if p.config.CleanupScript != path {
+		t.Fatalf("expected cleanup_script %s, got %s", path, p.config.CleanupScript)
+	}
+}
+
+func TestPostProcessorConfigure_TildeMissingScript(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	p := new(PostProcessor)
+	err := p.Configure(map[string]interface{}{"scripts": []string{"~/missing.sh"}})
+	if err == nil {
+		t.Fatal("expected an error for a missing script")
+	}
+}
+
+func TestPostProcessorPostProcess_FailOnAnyError(t *testing.T) {
+	for _, failOnAnyError := range []bool{true, false} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline_scripts": map[string]string{
+				"a.sh": "exit 1",
+				"b.sh": "exit 2",
+				"c.sh": "echo third",
+			},
+			"continue_on_error": true,
+			"fail_on_any_error": failOnAnyError,
+		})
+
+		ui := new(testUi)
+		image := writeFile(t, t.TempDir(), "image", "")
+		artifact, _, err := p.PostProcess(ui, testArtifact(image))
+		if artifact == nil {
+			t.Fatalf("fail_on_any_error %t: expected an artifact despite the failures", failOnAnyError)
+		}
+		if !strings.Contains(ui.out.String(), "third") {
+			t.Fatalf("fail_on_any_error %t: expected the remaining script to run, got output:\n%s",
+				failOnAnyError, ui.out.String())
+		}
+
+		if !failOnAnyError {
+			if err != nil {
+				t.Fatalf("fail_on_any_error false: expected no error, got %s", err)
+			}
+			continue
+		}
+		merr, ok := err.(*packer.MultiError)
+		if !ok {
+			t.Fatalf("fail_on_any_error true: expected a MultiError, got %#v", err)
+		}
+		if len(merr.Errors) != 2 {
+			t.Fatalf("fail_on_any_error true: expected 2 errors, got %d: %s", len(merr.Errors), merr)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_WorkingDir(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+
+	for _, tc := range []struct {
+		chdir bool
+		want  string
+	}{
+		{false, cwd},
+		{true, dir},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":            []string{`echo "working_dir=$PACKER_WORKING_DIR pwd=$(pwd -P)"`},
+			"chdir_to_artifact": tc.chdir,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		want, err := filepath.EvalSymlinks(tc.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(ui.out.String(), "working_dir="+tc.want+" pwd="+want) {
+			t.Fatalf("chdir_to_artifact %t: expected PACKER_WORKING_DIR %s, got output:\n%s",
+				tc.chdir, tc.want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorConfigure_TemplatedVarsFile(t *testing.T) {
+	varsFile := writeFile(t, t.TempDir(), "vars", "# comment\n\nNAME={{build_name}}\n")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"packer_build_name":     "web",
+		"inline":                []string{`echo "name=$NAME"`},
+		"environment_vars_file": varsFile,
+	})
+	if !containsString(p.config.Vars, "NAME=web") {
+		t.Fatalf("expected NAME=web in environment_vars, got %v", p.config.Vars)
+	}
+
+	ui := new(testUi)
+	image := writeFile(t, t.TempDir(), "image", "")
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "name=web") {
+		t.Fatalf("expected the script to see NAME=web, got output:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_DownloadRemoteArtifacts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/disk.img" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("remote contents"))
+	}))
+	defer server.Close()
+
+	tempDir := t.TempDir()
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":                    []string{`echo "file=$(basename "$1" | cut -c1-25) contents=$(cat "$1")"`},
+		"download_remote_artifacts": true,
+		"temp_dir":                  tempDir,
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(server.URL+"/disk.img")); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "file="+downloadPrefix) ||
+		!strings.Contains(ui.out.String(), "contents=remote contents") {
+		t.Fatalf("expected the script to get the downloaded file, got output:\n%s", ui.out.String())
+	}
+
+	left, err := filepath.Glob(filepath.Join(tempDir, downloadPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Fatalf("expected the download to be removed, found %v", left)
+	}
+
+	_, _, err = p.PostProcess(new(testUi), testArtifact(server.URL+"/missing.img"))
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected an error downloading a missing artifact, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_OutputStructure(t *testing.T) {
+	out := t.TempDir()
+	image := writeFile(t, t.TempDir(), "image", "contents")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"packer_build_name": "web",
+		"inline":            []string{"true"},
+		"provider":          "aws",
+		"output_structure":  out + "/{{.Provider}}/{{.BuildName}}/",
+	})
+
+	artifact, _, err := p.PostProcess(new(testUi), testArtifact(image))
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+
+	placed := filepath.Join(out, "aws", "web", "image")
+	if files := artifact.Files(); len(files) != 1 || files[0] != placed {
+		t.Fatalf("expected files [%s], got %v", placed, files)
+	}
+	if contents := readFile(t, placed); contents != "contents" {
+		t.Fatalf("expected the file to be placed with its contents, got %q", contents)
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Fatalf("expected the file to be moved, but %s still exists", image)
+	}
+}
+
+func TestPostProcessorPostProcess_PlaceChecksumSidecars(t *testing.T) {
+	for _, tc := range []struct {
+		provider  string
+		providers []string
+	}{
+		{"aws", []string{"aws"}},
+		{"aws,gcp", []string{"aws", "gcp"}},
+	} {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		image := writeFile(t, dir, "image", "contents")
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":           []string{"true"},
+			"compute_checksum": "sha256",
+			"checksum_sidecar": true,
+			"provider":         tc.provider,
+			"output_structure": out + "/{{.Provider}}",
+		})
+
+		artifact, _, err := p.PostProcess(new(testUi), testArtifact(image))
+		if err != nil {
+			t.Fatalf("%s: PostProcess: %s", tc.provider, err)
+		}
+		if _, err := os.Stat(image + ".sha256"); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the sidecar to be moved along with the file", tc.provider)
+		}
+		var sidecars []string
+		for _, provider := range tc.providers {
+			sidecar := filepath.Join(out, provider, "image.sha256")
+			if got := readFile(t, sidecar); got != sha256Hex("contents")+"  image\n" {
+				t.Errorf("%s: expected %s to hold the checksum, got %q", tc.provider, sidecar, got)
+			}
+			sidecars = append(sidecars, sidecar)
+		}
+
+		if err := artifact.Destroy(); err != nil {
+			t.Fatalf("%s: Destroy: %s", tc.provider, err)
+		}
+		for _, sidecar := range sidecars {
+			if _, err := os.Stat(sidecar); !os.IsNotExist(err) {
+				t.Errorf("%s: expected %s to be removed", tc.provider, sidecar)
+			}
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ScriptBOM(t *testing.T) {
+	tempDir := t.TempDir()
+	script := writeFile(t, t.TempDir(), "bom.sh", "\xEF\xBB\xBFecho bom-ok\n")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts":  []string{script},
+		"temp_dir": tempDir,
+	})
+
+	ui := new(testUi)
+	image := writeFile(t, t.TempDir(), "image", "")
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "bom-ok") {
+		t.Fatalf("expected the script to run, got output:\n%s", ui.out.String())
+	}
+
+	left, err := filepath.Glob(filepath.Join(tempDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) > 0 {
+		t.Fatalf("expected the stripped copy to be removed, found %v", left)
+	}
+}
+
+func TestPostProcessorPostProcess_TotalArtifactFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		writeFile(t, dir, "a.img", ""),
+		writeFile(t, dir, "b.img", ""),
+		writeFile(t, dir, "c.vmdk", ""),
+	}
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":     []string{`echo "total=$PACKER_TOTAL_ARTIFACT_FILES"`},
+		"extensions": []string{".img"},
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(files...)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	// Only two files are processed, but the total covers them all.
+	if n := strings.Count(ui.out.String(), "total=3"); n != 2 {
+		t.Fatalf("expected total=3 from both runs, found %d in output:\n%s", n, ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_NoScripts(t *testing.T) {
+	p := testPostProcessor(t, map[string]interface{}{"inline": []string{"true"}})
+	p.config.Inline = nil
+
+	image := writeFile(t, t.TempDir(), "image", "")
+	artifact, _, err := p.PostProcess(new(testUi), testArtifact(image))
+	if err == nil || !strings.Contains(err.Error(), "no scripts to run") {
+		t.Fatalf("expected the no scripts error, got %v", err)
+	}
+	if artifact != nil {
+		t.Fatalf("expected no artifact, got %v", artifact)
+	}
+}
+
+func TestPostProcessor_Provider(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		configured string
+		state      interface{}
+		builderId  string
+		want       string
+	}{
+		{"config", "gce", "azure", "mitchellh.amazonebs", "gce"},
+		{"state", "", "azure", "mitchellh.amazonebs", "azure"},
+		{"detected", "", nil, "mitchellh.amazonebs", "aws"},
+		{"empty state", "", "", "mitchellh.virtualbox", "virtualbox"},
+		{"builder type", "", nil, "unknown.builder", "custom"},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"packer_builder_type": "custom",
+			"inline":              []string{"true"},
+			"provider":            tc.configured,
+		})
+
+		artifact := testArtifact()
+		artifact.builderId = tc.builderId
+		if tc.state != nil {
+			artifact.state["provider"] = tc.state
+		}
+		if got := p.provider(artifact); got != tc.want {
+			t.Errorf("%s: expected provider %s, got %s", tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_StateProvider(t *testing.T) {
+	out := t.TempDir()
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{"true"},
+		"output_structure": out + "/{{.Provider}}",
+	})
+
+	input := testArtifact(image)
+	input.state["provider"] = "azure"
+	artifact, _, err := p.PostProcess(new(testUi), input)
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	placed := filepath.Join(out, "azure", "image")
+	if files := artifact.Files(); len(files) != 1 || files[0] != placed {
+		t.Fatalf("expected files [%s], got %v", placed, files)
+	}
+}
+
+func TestPostProcessorPostProcess_EmitDiff(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "one\ntwo\nthree\n")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":    []string{`printf 'one\nTWO\nthree\n' > "$1"`},
+		"emit_diff": true,
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	want := "--- " + image + " (before)\n+++ " + image + " (after)\n@@ -1,3 +1,3 @@\n one\n-two\n+TWO\n three\n"
+	if !strings.Contains(ui.out.String(), want) {
+		t.Fatalf("expected the diff:\n%s\ngot output:\n%s", want, ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_RetrySchedule(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		delays   []time.Duration
+		fails    bool
+	}{
+		{0, nil, false},
+		{2, []time.Duration{time.Second, 5 * time.Second}, false},
+		{5, []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}, true},
+	} {
+		delays := recordSleeps(t)
+		count := filepath.Join(t.TempDir(), "count")
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline": []string{
+				"n=$(($(cat " + count + " 2>/dev/null || echo 0) + 1))",
+				"echo $n > " + count,
+				"[ $n -gt " + strconv.Itoa(tc.failures) + " ]",
+			},
+			"retry_schedule": []string{"1s", "5s", "30s"},
+		})
+
+		image := writeFile(t, t.TempDir(), "image", "")
+		_, _, err := p.PostProcess(new(testUi), testArtifact(image))
+		if tc.fails != (err != nil) {
+			t.Fatalf("%d failures: expected failure %t, got error %v", tc.failures, tc.fails, err)
+		}
+		if !reflect.DeepEqual(*delays, tc.delays) {
+			t.Fatalf("%d failures: expected delays %v, got %v", tc.failures, tc.delays, *delays)
+		}
+		if attempts := strings.TrimSpace(readFile(t, count)); attempts != strconv.Itoa(len(tc.delays)+1) {
+			t.Fatalf("%d failures: expected %d attempts, got %s", tc.failures, len(tc.delays)+1, attempts)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ForwardSSHAgent(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/run/agent.sock")
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, forward := range []bool{true, false} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":            []string{`echo "sock=$SSH_AUTH_SOCK."`},
+			"forward_ssh_agent": forward,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		want := "sock=."
+		if forward {
+			want = "sock=/run/agent.sock."
+		}
+		if !strings.Contains(ui.out.String(), want) {
+			t.Fatalf("forward_ssh_agent %t: expected %s, got output:\n%s", forward, want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ForwardSSHAgentUnset(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":            []string{"true"},
+		"forward_ssh_agent": true,
+	})
+
+	ui := new(testUi)
+	image := writeFile(t, t.TempDir(), "image", "")
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "SSH_AUTH_SOCK is not set") {
+		t.Fatalf("expected a message that there is no agent, got output:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_PrecheckCommand(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		contents string
+		passes   bool
+	}{
+		{"a disk image", true},
+		{"something else", false},
+	} {
+		image := writeFile(t, dir, "image", tc.contents)
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":           []string{"echo script-ran"},
+			"precheck_command": `grep -q disk "$1"`,
+		})
+
+		ui := new(testUi)
+		_, _, err := p.PostProcess(ui, testArtifact(image))
+		ran := strings.Contains(ui.out.String(), "script-ran")
+		if tc.passes {
+			if err != nil || !ran {
+				t.Fatalf("expected the precheck to pass and the script to run, got error %v and output:\n%s",
+					err, ui.out.String())
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "Precheck failed for artifact "+image) {
+			t.Fatalf("expected the precheck to fail, got %v", err)
+		}
+		if ran {
+			t.Fatal("expected the script not to run after a failed precheck")
+		}
+	}
+}
+
+func TestPostProcessorConfigure_StatsScriptsOnce(t *testing.T) {
+	dir := t.TempDir()
+	var scripts []string
+	for i := 0; i < 3; i++ {
+		script := writeFile(t, dir, strconv.Itoa(i)+".sh", "echo "+strconv.Itoa(i)+"\n")
+		for j := 0; j < 10; j++ {
+			scripts = append(scripts, script)
+		}
+	}
+
+	stats := make(map[string]int)
+	statScript = func(path string) (os.FileInfo, error) {
+		stats[path]++
+		return os.Stat(path)
+	}
+	defer func() { statScript = os.Stat }()
+
+	p := testPostProcessor(t, map[string]interface{}{"scripts": scripts})
+	images := []string{
+		writeFile(t, dir, "a.img", ""),
+		writeFile(t, dir, "b.img", ""),
+	}
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(images...)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+
+	if len(stats) != 3 {
+		t.Fatalf("expected 3 scripts to be checked, got %v", stats)
+	}
+	for path, n := range stats {
+		if n != 1 {
+			t.Errorf("expected %s to be checked once, got %d", path, n)
+		}
+	}
+}
+
+func BenchmarkPostProcessorConfigure_ManyScripts(b *testing.B) {
+	dir := b.TempDir()
+	scripts := make([]string, 500)
+	for i := range scripts {
+		scripts[i] = filepath.Join(dir, strconv.Itoa(i%50)+".sh")
+		if err := ioutil.WriteFile(scripts[i], []byte("true\n"), 0755); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := new(PostProcessor)
+		if err := p.Configure(map[string]interface{}{"scripts": scripts}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_BuilderTypes(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, tc := range []struct {
+		option string
+		types  []string
+		runs   bool
+	}{
+		{"only_builder_types", []string{"amazon-ebs", "docker"}, true},
+		{"only_builder_types", []string{"amazon-ebs"}, false},
+		{"except_builder_types", []string{"docker"}, false},
+		{"except_builder_types", []string{"amazon-ebs"}, true},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"packer_builder_type": "docker",
+			"inline":              []string{"echo script-ran"},
+			tc.option:             tc.types,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("%s %v: PostProcess: %s", tc.option, tc.types, err)
+		}
+		if ran := strings.Contains(ui.out.String(), "script-ran"); ran != tc.runs {
+			t.Errorf("%s %v: expected the scripts to run: %t", tc.option, tc.types, tc.runs)
+		}
+	}
+
+	for _, tc := range []struct {
+		raw  map[string]interface{}
+		want string
+	}{
+		{
+			map[string]interface{}{"only_builder_types": []string{"docker"}, "except_builder_types": []string{"qemu"}},
+			"Only one of only_builder_types or except_builder_types",
+		},
+		{map[string]interface{}{"except_builder_types": []string{" "}}, "except_builder_types[0] must not be empty"},
+	} {
+		tc.raw["inline"] = []string{"true"}
+		if err := new(PostProcessor).Configure(tc.raw); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expected an error containing %q, got %v", tc.want, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_Shell(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash isn't installed")
+	}
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	script := writeFile(t, dir, "script.sh", `echo "script shell=$PACKER_SHELL"`)
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":         []string{`echo "inline shell=$PACKER_SHELL"`},
+		"inline_shebang": "bash",
+		"pre_scripts":    []string{script},
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	for _, want := range []string{"inline shell=" + bash, "script shell=/bin/sh"} {
+		if !strings.Contains(ui.out.String(), want) {
+			t.Fatalf("expected %s, got output:\n%s", want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_EnvPrecedence(t *testing.T) {
+	t.Setenv("PACKER_BUILD_NAME", "inherited")
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, tc := range []struct {
+		precedence []string
+		want       string
+	}{
+		{nil, "packer"},
+		{[]string{"inherited", "packer", "user"}, "user"},
+		{[]string{"user", "packer", "inherited"}, "inherited"},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"packer_build_name": "packer",
+			"inline":            []string{`echo "build_name=$PACKER_BUILD_NAME"`},
+			"environment_vars":  []string{"PACKER_BUILD_NAME=user"},
+			"env_precedence":    tc.precedence,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		if !strings.Contains(ui.out.String(), "build_name="+tc.want+"\n") {
+			t.Fatalf("%v: expected PACKER_BUILD_NAME=%s, got output:\n%s", tc.precedence, tc.want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorConfigure_SampleArtifactFiles(t *testing.T) {
+	dir := t.TempDir()
+	good := writeFile(t, dir, "good.sh", "echo {{.BuildName}} {{.ArtifactId}}\n")
+	bad := writeFile(t, dir, "bad.sh", "echo {{.Nope}}\n")
+
+	for _, tc := range []struct {
+		name   string
+		raw    map[string]interface{}
+		errors string
+	}{
+		{
+			"valid",
+			map[string]interface{}{"scripts": []string{good}, "template_scripts": true, "dry_run": true},
+			"",
+		},
+		{
+			"bad script template",
+			map[string]interface{}{"scripts": []string{bad}, "template_scripts": true, "dry_run": true},
+			"Error interpolating script " + bad,
+		},
+		{
+			"empty target field",
+			map[string]interface{}{"mode": "copy", "target": dir + "/{{.Provider}}", "dry_run": true},
+			"target refers to {{.Provider}}",
+		},
+		{
+			"without dry_run",
+			map[string]interface{}{"scripts": []string{good}},
+			"sample_artifact_files can only be used with dry_run",
+		},
+	} {
+		tc.raw["sample_artifact_files"] = []string{filepath.Join(dir, "sample.img")}
+		err := new(PostProcessor).Configure(tc.raw)
+		if tc.errors == "" {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %s", tc.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tc.errors) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.errors, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_DryRun(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	marker := filepath.Join(dir, "marker")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":  []string{"touch " + marker},
+		"dry_run": true,
+	})
+
+	ui := new(testUi)
+	artifact, _, err := p.PostProcess(ui, testArtifact(image))
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if _, err := os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatal("expected the script not to run")
+	}
+	if !strings.Contains(ui.out.String(), "Would run: /bin/sh ") {
+		t.Fatalf("expected the command to be shown, got output:\n%s", ui.out.String())
+	}
+	if files := artifact.Files(); len(files) != 1 || files[0] != image {
+		t.Fatalf("expected the artifact unchanged, got files %v", files)
+	}
+}
+
+func TestPostProcessor_LastOutput(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline_scripts": map[string]string{
+			"1.sh": "echo first-out; echo first-err >&2",
+			"2.sh": "echo second-out",
+		},
+	})
+
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if got, want := p.LastOutput(), "first-out\nfirst-err\nsecond-out\n"; got != want {
+		t.Fatalf("expected LastOutput %q, got %q", want, got)
+	}
+
+	// Only the most recent run is kept.
+	p.config.InlineScripts = map[string]string{"3.sh": "echo third-out"}
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if got, want := p.LastOutput(), "third-out\n"; got != want {
+		t.Fatalf("expected LastOutput %q, got %q", want, got)
+	}
+}
+
+func TestPostProcessor_LastOutputLimit(t *testing.T) {
+	dir := t.TempDir()
+	images := []string{
+		writeFile(t, dir, "a.img", ""),
+		writeFile(t, dir, "b.img", ""),
+		writeFile(t, dir, "c.img", ""),
+	}
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{"echo 0123456789"},
+		"max_output_bytes": 16,
+	})
+
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(images...)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if got, want := p.LastOutput(), "0123456789\n01234\n(output truncated)\n"; got != want {
+		t.Fatalf("expected LastOutput %q, got %q", want, got)
+	}
+}
+
+func TestPostProcessorPostProcess_RecurseDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		writeFile(t, dir, "disk.img", ""),
+		writeFile(t, filepath.Join(dir, "nested"), "a.vmdk", ""),
+		writeFile(t, filepath.Join(dir, "nested", "deeper"), "b.ovf", ""),
+	}
+
+	for _, recurse := range []bool{true, false} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":            []string{`echo "arg=$1"`},
+			"recurse_directory": recurse,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(dir)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+
+		want := []string{"arg=" + dir}
+		if recurse {
+			want = nil
+			for _, file := range files {
+				want = append(want, "arg="+file)
+			}
+		}
+		var got []string
+		for _, line := range strings.Split(ui.out.String(), "\n") {
+			if strings.HasPrefix(line, "arg=") {
+				got = append(got, line)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("recurse_directory %t: expected runs %v, got %v", recurse, want, got)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_NoStdoutWrites(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline": []string{"echo script-output"},
+		"debug":  true,
+	})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	ui := new(testUi)
+	_, _, err = p.PostProcess(ui, testArtifact(image))
+	os.Stdout = stdout
+	w.Close()
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+
+	written, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(written) > 0 {
+		t.Fatalf("expected nothing written to stdout, got %q", written)
+	}
+	if !strings.Contains(ui.out.String(), "script-output") {
+		t.Fatalf("expected the script's output to go to the UI, got:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_CleanupScript(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{writeFile(t, dir, "a", ""), writeFile(t, dir, "b", "")}
+	cleanup := writeFile(t, dir, "cleanup.sh", `echo "cleanup: $*"; exit 1`)
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":         []string{"exit 3"},
+		"cleanup_script": cleanup,
+		"script_args":    []string{"--verify"},
+	})
+
+	ui := new(testUi)
+	_, _, err := p.PostProcess(ui, testArtifact(files...))
+	if scriptErr, ok := err.(*ScriptError); !ok || scriptErr.ExitCode != 3 {
+		t.Fatalf("expected the script's failure to be returned, got %v", err)
+	}
+	want := "cleanup: " + files[0] + " " + files[1] + " --verify\n"
+	if !strings.Contains(ui.out.String(), want) {
+		t.Errorf("expected the cleanup script to run with the artifact files first, got:\n%s", ui.out.String())
+	}
+	if !strings.Contains(ui.out.String(), "Warning: cleanup script failed") {
+		t.Errorf("expected the cleanup script's failure to be a warning, got:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorCommand_Trace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("strace is only used on linux")
+	}
+	p := testPostProcessor(t, map[string]interface{}{"inline": []string{"true"}})
+	p.config.Trace = true
+	p.config.TraceOutput = "/tmp/trace.out"
+
+	cmd, err := p.command(script{name: "s.sh", path: "s.sh"}, "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"strace", "-f", "-A", "-o", "/tmp/trace.out", "/bin/sh", "s.sh", "image"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Fatalf("expected %v, got %v", want, cmd.Args)
+	}
+}
+
+func TestPostProcessorPostProcess_Trace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("trace is only tested on linux")
+	}
+	if _, err := exec.LookPath("strace"); err != nil {
+		t.Skip("strace isn't installed")
+	}
+	dir := t.TempDir()
+	traceOutput := filepath.Join(dir, "trace.out")
+	image := writeFile(t, dir, "image", "")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":       []string{"echo traced"},
+		"trace":        true,
+		"trace_output": traceOutput,
+	})
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if trace := readFile(t, traceOutput); !strings.Contains(trace, "execve(") {
+		t.Fatalf("expected the trace to be written, got:\n%s", trace)
+	}
+}
+
+func TestPostProcessorPostProcess_FailOnFirstStderr(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	for _, combined := range []bool{false, true} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":               []string{"echo starting", "sleep 30 &", "echo boom >&2", "wait", "echo finished"},
+			"fail_on_first_stderr": true,
+			"capture_combined":     combined,
+		})
+
+		ui := new(testUi)
+		start := time.Now()
+		_, _, err := p.PostProcess(ui, testArtifact(image))
+		if err == nil || !strings.Contains(err.Error(), "script wrote to stderr") {
+			t.Fatalf("capture_combined %t: expected the script to fail for writing to stderr, got %v", combined, err)
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Fatalf("capture_combined %t: expected the script to be killed right away, took %s", combined, elapsed)
+		}
+		if strings.Contains(ui.out.String(), "finished") {
+			t.Fatalf("capture_combined %t: expected the script to be killed before it finished", combined)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_EnvMatchesSchema(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	list := `env | sed -n 's/^\(PACKER_[A-Z_]*\)=.*/var:\1/p'`
+	pre := writeFile(t, dir, "pre.sh", list)
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{list},
+		"pre_scripts":      []string{pre},
+		"write_vars_file":  true,
+		"compute_checksum": "sha256",
+		"pass_artifact_fd": true,
+		"sequence_file":    filepath.Join(dir, "seq"),
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+
+	set := make(map[string]bool)
+	for _, line := range strings.Split(ui.out.String(), "\n") {
+		if strings.HasPrefix(line, "var:") {
+			set[strings.TrimPrefix(line, "var:")] = true
+		}
+	}
+	schema := make(map[string]bool)
+	for _, name := range RequiredEnvSchema() {
+		schema[name] = true
+		if !set[name] {
+			t.Errorf("expected %s to be set", name)
+		}
+	}
+	for name := range set {
+		if !schema[name] {
+			t.Errorf("%s is set but missing from RequiredEnvSchema", name)
+		}
+	}
+}
+
+func TestPostProcessorConfigure_RunOnce(t *testing.T) {
+	for option, value := range map[string]interface{}{
+		"extensions":       []string{".img"},
+		"file_index":       0,
+		"compute_checksum": "sha256",
+	} {
+		err := new(PostProcessor).Configure(map[string]interface{}{
+			"inline":   []string{"true"},
+			"run_once": true,
+			option:     value,
+		})
+		if err == nil || !strings.Contains(err.Error(), option) || !strings.Contains(err.Error(), "run_once") {
+			t.Errorf("expected %s to be rejected with run_once, got %v", option, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ScriptError(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	script := writeFile(t, dir, "fail.sh", "echo progress\necho oops >&2\nexit 3\n")
+
+	p := testPostProcessor(t, map[string]interface{}{"scripts": []string{script}})
+	_, _, err := p.PostProcess(new(testUi), testArtifact(image))
+
+	scriptErr, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expected a ScriptError, got %#v", err)
+	}
+	if scriptErr.Script != script {
+		t.Errorf("expected Script %s, got %s", script, scriptErr.Script)
+	}
+	if scriptErr.File != image {
+		t.Errorf("expected File %s, got %s", image, scriptErr.File)
+	}
+	if scriptErr.ExitCode != 3 {
+		t.Errorf("expected ExitCode 3, got %d", scriptErr.ExitCode)
+	}
+	if scriptErr.Stderr != "oops\n" {
+		t.Errorf("expected Stderr %q, got %q", "oops\n", scriptErr.Stderr)
+	}
+	if scriptErr.Err == nil {
+		t.Error("expected the underlying error to be kept")
+	}
+}
+
+// sha256Hex returns the hex encoded SHA-256 checksum of contents.
+func sha256Hex(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPostProcessorPostProcess_ScriptChecksums(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	contents := "echo verified\n"
+	script := writeFile(t, dir, "script.sh", contents)
+
+	for _, tc := range []struct {
+		sum     string
+		matches bool
+	}{
+		{sha256Hex(contents), true},
+		{strings.ToUpper(sha256Hex(contents)), true},
+		{sha256Hex("echo tampered\n"), false},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"scripts":          []string{script},
+			"script_checksums": map[string]string{script: tc.sum},
+		})
+
+		ui := new(testUi)
+		_, _, err := p.PostProcess(ui, testArtifact(image))
+		ran := strings.Contains(ui.out.String(), "verified")
+		if tc.matches {
+			if err != nil || !ran {
+				t.Fatalf("expected a matching checksum to run the script, got error %v", err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+			t.Fatalf("expected a checksum mismatch, got %v", err)
+		}
+		if ran {
+			t.Fatal("expected the script not to run")
+		}
+	}
+}
+
+func TestPostProcessorConfigure_ScriptChecksums(t *testing.T) {
+	dir := t.TempDir()
+	script := writeFile(t, dir, "script.sh", "true\n")
+	other := writeFile(t, dir, "other.sh", "true\n")
+
+	for _, tc := range []struct {
+		checksums map[string]string
+		errors    string
+	}{
+		{map[string]string{script: "not-hex"}, "isn't a hex encoded SHA-256 checksum"},
+		{map[string]string{script: "abcd"}, "isn't a hex encoded SHA-256 checksum"},
+		{map[string]string{other: sha256Hex("true\n")}, "references a script that isn't listed"},
+	} {
+		err := new(PostProcessor).Configure(map[string]interface{}{
+			"scripts":          []string{script},
+			"script_checksums": tc.checksums,
+		})
+		if err == nil || !strings.Contains(err.Error(), tc.errors) {
+			t.Errorf("%v: expected an error containing %q, got %v", tc.checksums, tc.errors, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_AbortFile(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	abortFile := filepath.Join(dir, "abort")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline_scripts": map[string]string{
+			"1.sh": "echo first; touch " + abortFile,
+			"2.sh": "echo second",
+		},
+		"abort_file": abortFile,
+	})
+
+	ui := new(testUi)
+	_, _, err := p.PostProcess(ui, testArtifact(image))
+	if err == nil || !strings.Contains(err.Error(), "abort file "+abortFile+" exists") {
+		t.Fatalf("expected processing to be aborted, got %v", err)
+	}
+	if !strings.Contains(ui.out.String(), "first") {
+		t.Fatal("expected the first script to run")
+	}
+	if strings.Contains(ui.out.String(), "second") {
+		t.Fatal("expected the second script not to run once the abort file existed")
+	}
+}
+
+func TestPostProcessorPostProcess_AbortFileOnce(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	abortFile := filepath.Join(dir, "abort")
+	pre := writeFile(t, dir, "pre.sh", "echo pre-ran")
+	post := writeFile(t, dir, "post.sh", "echo post-ran")
+
+	for _, tc := range []struct {
+		name    string
+		exists  bool
+		script  string
+		ran     []string
+		skipped []string
+	}{
+		{"before pre_scripts", true, "echo main-ran", nil, []string{"pre-ran", "main-ran", "post-ran"}},
+		{"before post_scripts", false, "echo main-ran; touch " + abortFile, []string{"pre-ran", "main-ran"}, []string{"post-ran"}},
+	} {
+		os.Remove(abortFile)
+		if tc.exists {
+			writeFile(t, dir, "abort", "")
+		}
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":       []string{tc.script},
+			"pre_scripts":  []string{pre},
+			"post_scripts": []string{post},
+			"abort_file":   abortFile,
+		})
+
+		ui := new(testUi)
+		_, _, err := p.PostProcess(ui, testArtifact(image))
+		if err == nil || !strings.Contains(err.Error(), "abort file "+abortFile+" exists") {
+			t.Fatalf("%s: expected processing to be aborted, got %v", tc.name, err)
+		}
+		for _, out := range tc.ran {
+			if !strings.Contains(ui.out.String(), out) {
+				t.Errorf("%s: expected %s", tc.name, out)
+			}
+		}
+		for _, out := range tc.skipped {
+			if strings.Contains(ui.out.String(), out) {
+				t.Errorf("%s: expected no %s", tc.name, out)
+			}
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_OverridePackerVars(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, override := range []bool{true, false} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"packer_build_name":   "packer-name",
+			"packer_builder_type": "packer-type",
+			"inline": []string{
+				`echo "name=$PACKER_BUILD_NAME type=$PACKER_BUILDER_TYPE"`,
+				`echo "count=$(env | grep -c '^PACKER_BUILD_NAME=')"`,
+			},
+			"environment_vars":     []string{"PACKER_BUILD_NAME=user-name"},
+			"override_packer_vars": override,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		want := "name=packer-name type=packer-type"
+		if override {
+			want = "name=user-name type=packer-type"
+		}
+		for _, line := range []string{want, "count=1"} {
+			if !strings.Contains(ui.out.String(), line+"\n") {
+				t.Fatalf("override_packer_vars %t: expected %s, got output:\n%s", override, line, ui.out.String())
+			}
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_BuildTimestamp(t *testing.T) {
+	dir := t.TempDir()
+	images := []string{writeFile(t, dir, "a.img", ""), writeFile(t, dir, "b.img", "")}
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline": []string{`echo "timestamp=$PACKER_BUILD_TIMESTAMP"`},
+	})
+
+	start := time.Now().Truncate(time.Second)
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(images...)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	end := time.Now()
+
+	var stamps []string
+	for _, line := range strings.Split(ui.out.String(), "\n") {
+		if strings.HasPrefix(line, "timestamp=") {
+			stamps = append(stamps, strings.TrimPrefix(line, "timestamp="))
+		}
+	}
+	if len(stamps) != 2 || stamps[0] != stamps[1] {
+		t.Fatalf("expected the same timestamp for both files, got %v", stamps)
+	}
+	stamp, err := time.Parse(time.RFC3339, stamps[0])
+	if err != nil {
+		t.Fatalf("expected an RFC3339 timestamp: %s", err)
+	}
+	if stamp.Before(start) || stamp.After(end) {
+		t.Fatalf("expected a timestamp between %s and %s, got %s", start, end, stamp)
+	}
+}
+
+func TestPostProcessorPostProcess_ChdirToArtifact(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	writeFile(t, dir, "image", "")
+	nested := writeFile(t, filepath.Join(dir, "bundle", "disks"), "disk.vmdk", "")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":            []string{`echo "pwd=$(pwd) arg=$1"`},
+		"chdir_to_artifact": true,
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact("image", "bundle/disks/disk.vmdk")); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	for _, want := range []string{
+		"pwd=" + dir + " arg=" + filepath.Join(dir, "image"),
+		"pwd=" + filepath.Dir(nested) + " arg=" + nested,
+	} {
+		if !strings.Contains(ui.out.String(), want+"\n") {
+			t.Fatalf("expected %s, got output:\n%s", want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ShowProgress(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for i := 0; i < 5; i++ {
+		files = append(files, writeFile(t, dir, strconv.Itoa(i)+".img", ""))
+	}
+
+	for _, show := range []interface{}{nil, true, false} {
+		raw := map[string]interface{}{"inline": []string{"true"}}
+		if show != nil {
+			raw["show_progress"] = show
+		}
+		p := testPostProcessor(t, raw)
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(files...)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		for i, file := range files {
+			line := "Processing file " + strconv.Itoa(i+1) + " of 5: " + file + "\n"
+			if shown := strings.Contains(ui.out.String(), line); shown != (show != false) {
+				t.Fatalf("show_progress %v: expected %q shown %t, got output:\n%s", show, line, show != false, ui.out.String())
+			}
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_SkipReturns(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, skipReturns := range []string{"", "original", "empty", "error"} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"packer_builder_type": "docker",
+			"inline":              []string{"echo script-ran"},
+			"only_builder_types":  []string{"amazon-ebs"},
+			"skip_returns":        skipReturns,
+		})
+
+		ui := new(testUi)
+		input := testArtifact(image)
+		artifact, _, err := p.PostProcess(ui, input)
+		if strings.Contains(ui.out.String(), "script-ran") {
+			t.Fatalf("skip_returns %q: expected the scripts not to run", skipReturns)
+		}
+
+		switch skipReturns {
+		case "", "original":
+			if err != nil || artifact != input {
+				t.Fatalf("skip_returns %q: expected the input artifact, got %v, %v", skipReturns, artifact, err)
+			}
+		case "empty":
+			if err != nil || artifact == nil || len(artifact.Files()) != 0 {
+				t.Fatalf("skip_returns %q: expected an artifact without files, got %v, %v", skipReturns, artifact, err)
+			}
+			if artifact.BuilderId() != input.BuilderId() {
+				t.Fatalf("skip_returns %q: expected builder ID %s, got %s", skipReturns, input.BuilderId(), artifact.BuilderId())
+			}
+		case "error":
+			if err == nil || artifact != nil {
+				t.Fatalf("skip_returns %q: expected an error, got %v, %v", skipReturns, artifact, err)
+			}
+		}
+	}
+
+	if err := new(PostProcessor).Configure(map[string]interface{}{
+		"inline":       []string{"true"},
+		"skip_returns": "nothing",
+	}); err == nil || !strings.Contains(err.Error(), "skip_returns must be one of") {
+		t.Fatalf("expected an error for a bad skip_returns, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_PassArtifactFd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("pass_artifact_fd isn't supported on windows")
+	}
+	dir := t.TempDir()
+	images := []string{writeFile(t, dir, "a.img", "first"), writeFile(t, dir, "b.img", "second")}
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline_scripts": map[string]string{
+			"1.sh": `echo "fd=$PACKER_ARTIFACT_FD read=$(cat <&$PACKER_ARTIFACT_FD)"`,
+			// Each script reads the file from the start.
+			"2.sh": `echo "again=$(cat <&$PACKER_ARTIFACT_FD)"`,
+		},
+		"pass_artifact_fd": true,
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(images...)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	for _, want := range []string{"fd=3 read=first", "again=first", "fd=3 read=second", "again=second"} {
+		if !strings.Contains(ui.out.String(), want+"\n") {
+			t.Fatalf("expected %s, got output:\n%s", want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_BuilderId(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	p := testPostProcessor(t, map[string]interface{}{"inline": []string{"true"}})
+
+	in := testArtifact(image)
+	in.builderId = "mitchellh.virtualbox"
+	out, _, err := p.PostProcess(new(testUi), in)
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if out.BuilderId() != in.BuilderId() {
+		t.Fatalf("expected builder ID %s, got %s", in.BuilderId(), out.BuilderId())
+	}
+}
+
+func TestPostProcessorPostProcess_AllowDaemonize(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	pidFile := filepath.Join(dir, "pid")
+	defer func() {
+		if pid, err := strconv.Atoi(strings.TrimSpace(readFile(t, pidFile))); err == nil {
+			if process, err := os.FindProcess(pid); err == nil {
+				process.Kill()
+			}
+		}
+	}()
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":          []string{"sleep 30 &", "echo $! > " + pidFile, "echo started"},
+		"allow_daemonize": true,
+	})
+
+	ui := new(testUi)
+	start := time.Now()
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected the run to finish promptly, took %s", elapsed)
+	}
+	if !strings.Contains(ui.out.String(), "started") {
+		t.Fatalf("expected the script's output, got:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_SequenceFile(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	sequenceFile := filepath.Join(dir, "seq")
+
+	for _, tc := range []struct {
+		dryRun bool
+		want   string
+	}{
+		{false, "1"},
+		{false, "2"},
+		{true, ""},
+		{false, "3"},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":        []string{`echo "seq=$PACKER_RUN_SEQ"`},
+			"sequence_file": sequenceFile,
+			"dry_run":       tc.dryRun,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		if !tc.dryRun && !strings.Contains(ui.out.String(), "seq="+tc.want+"\n") {
+			t.Fatalf("expected PACKER_RUN_SEQ=%s, got output:\n%s", tc.want, ui.out.String())
+		}
+	}
+	if contents := readFile(t, sequenceFile); contents != "3\n" {
+		t.Fatalf("expected dry runs not to increment the counter, got %q", contents)
+	}
+}
+
+func TestPostProcessorPostProcess_PassthroughState(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":            []string{"true"},
+		"passthrough_state": []string{"region", "ami", "missing"},
+	})
+
+	in := testArtifact(image)
+	in.state["region"] = "us-east-1"
+	in.state["ami"] = map[string]string{"us-east-1": "ami-1234"}
+	in.state["secret"] = "not copied"
+	out, _, err := p.PostProcess(new(testUi), in)
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+
+	if got := out.State("region"); got != "us-east-1" {
+		t.Errorf("expected region us-east-1, got %v", got)
+	}
+	if got := out.State("ami"); !reflect.DeepEqual(got, in.state["ami"]) {
+		t.Errorf("expected ami %v, got %v", in.state["ami"], got)
+	}
+	for _, key := range []string{"secret", "missing"} {
+		if got := out.State(key); got != nil {
+			t.Errorf("expected %s not to be set, got %v", key, got)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ProduceIfOutput(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, tc := range []struct {
+		output   string
+		produces bool
+	}{
+		{"result: changed", true},
+		{"result: unchanged", false},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline_scripts": map[string]string{
+				"1.sh": "echo result: changed",
+				"2.sh": "echo " + tc.output,
+			},
+			"produce_if_output": "^result: changed",
+		})
+
+		in := testArtifact(image)
+		out, _, err := p.PostProcess(new(testUi), in)
+		if err != nil {
+			t.Fatalf("PostProcess: %s", err)
+		}
+		// Only the last script's output counts.
+		if produced := out != packer.Artifact(in); produced != tc.produces {
+			t.Fatalf("output %q: expected a new artifact %t, got %t", tc.output, tc.produces, produced)
+		}
+	}
+
+	if err := new(PostProcessor).Configure(map[string]interface{}{
+		"inline":            []string{"true"},
+		"produce_if_output": "(",
+	}); err == nil || !strings.Contains(err.Error(), "Bad produce_if_output pattern") {
+		t.Fatalf("expected an error for a bad pattern, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_ProduceIfOutputContinueOnError(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, failOnAnyError := range []bool{true, false} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline_scripts": map[string]string{
+				"1.sh": "exit 3",
+				"2.sh": "echo result: unchanged",
+			},
+			"produce_if_output": "^result: changed",
+			"continue_on_error": true,
+			"fail_on_any_error": failOnAnyError,
+		})
+
+		in := testArtifact(image)
+		out, _, err := p.PostProcess(new(testUi), in)
+		if failOnAnyError && err == nil {
+			t.Errorf("fail_on_any_error %t: expected the script failure to be returned", failOnAnyError)
+		} else if !failOnAnyError && err != nil {
+			t.Errorf("fail_on_any_error %t: PostProcess: %s", failOnAnyError, err)
+		}
+		if out != packer.Artifact(in) {
+			t.Errorf("fail_on_any_error %t: expected the artifact to be returned unchanged", failOnAnyError)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_ShellConfig(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	out := filepath.Join(dir, "config.json")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{`printf '%s' "$PACKER_SHELL_CONFIG" > ` + out},
+		"environment_vars": []string{"TOKEN=hunter2"},
+	})
+
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+
+	contents := readFile(t, out)
+	if strings.Contains(contents, "hunter2") {
+		t.Fatalf("expected secrets to be redacted, got %s", contents)
+	}
+	var options map[string]interface{}
+	if err := json.Unmarshal([]byte(contents), &options); err != nil {
+		t.Fatalf("expected PACKER_SHELL_CONFIG to be JSON: %s", err)
+	}
+	want := []interface{}{"TOKEN=" + redacted}
+	if got := options["environment_vars"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected environment_vars %v, got %v", want, got)
+	}
+}
+
+// panicUi panics when it is told a script is about to run.
+type panicUi struct {
+	testUi
+}
+
+func (u *panicUi) Say(message string) {
+	if strings.HasPrefix(message, "Process with shell script") {
+		panic(message)
+	}
+	u.testUi.Say(message)
+}
+
+func TestPostProcessorPostProcess_CleanupOnPanic(t *testing.T) {
+	dir := t.TempDir()
+	tempDir := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tempDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	image := writeFile(t, dir, "image", "")
+	script := writeFile(t, dir, "script.sh", "echo $1\r\n")
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts":                []string{script},
+		"inline_scripts":         map[string]string{"lib.sh": "true"},
+		"normalize_line_endings": true,
+		"environment_vars":       []string{"A=1"},
+		"temp_dir":               tempDir,
+	})
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected PostProcess to panic")
+			}
+		}()
+		p.PostProcess(new(panicUi), testArtifact(image))
+	}()
+
+	entries, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("expected %s to be removed", entry.Name())
+	}
+}
+
+func TestSweepTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-orphanedTempFileAge - time.Hour)
+	files := map[string]bool{
+		tempPrefix + "old.sh":            true,
+		tempPrefix + "manifest-old/file": true,
+		tempPrefix + "young.sh":          false,
+		keptTempPrefix + "old.sh":        false,
+		downloadPrefix + "old":           false,
+		"packer-shell-old":               false,
+	}
+	for name := range files {
+		path := writeFile(t, filepath.Dir(filepath.Join(dir, name)), filepath.Base(name), "")
+		if strings.Contains(name, "young") {
+			continue
+		}
+		for ; path != dir; path = filepath.Dir(path) {
+			if err := os.Chtimes(path, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	sweepTempFiles(dir)
+
+	for name, removed := range files {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if removed && !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", name)
+		} else if !removed && err != nil {
+			t.Errorf("expected %s to be kept: %s", name, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_NormalizeEnvCase(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	for _, tc := range []struct {
+		normalize string
+		want      string
+	}{
+		{"", "REGION=us-west-2 region=us-east-1"},
+		{"preserve", "REGION=us-west-2 region=us-east-1"},
+		{"upper", "REGION=us-west-2 region="},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":             []string{`echo "REGION=$REGION region=$region"`},
+			"environment_vars":   []string{"region=us-east-1", "REGION=us-west-2"},
+			"normalize_env_case": tc.normalize,
+		})
+
+		ui := new(testUi)
+		if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+			t.Fatalf("%q: PostProcess: %s", tc.normalize, err)
+		}
+		if !strings.Contains(ui.out.String(), tc.want) {
+			t.Errorf("%q: expected output to contain %q, got:\n%s", tc.normalize, tc.want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorConfigure_NormalizeEnvCase(t *testing.T) {
+	p := new(PostProcessor)
+	err := p.Configure(map[string]interface{}{
+		"inline":             []string{"true"},
+		"normalize_env_case": "lower",
+	})
+	if err == nil || !strings.Contains(err.Error(), "normalize_env_case must be one of") {
+		t.Fatalf("expected a normalize_env_case error, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_ScriptArgs(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image with spaces", "")
+	script := writeFile(t, dir, "args.sh", `for arg in "$@"; do echo "[$arg]"; done`)
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts":               []string{script},
+		"script_args":           []string{"--verify", "two  words", "", `--region={{user "region"}}`},
+		"packer_user_variables": map[string]string{"region": "us east"},
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	want := "[" + image + "]\n[--verify]\n[two  words]\n[]\n[--region=us east]\n"
+	if !strings.Contains(ui.out.String(), want) {
+		t.Fatalf("expected arguments:\n%s\ngot:\n%s", want, ui.out.String())
+	}
+}
+
+func TestPostProcessorCommand_CPUAffinity(t *testing.T) {
+	p := testPostProcessor(t, map[string]interface{}{"inline": []string{"true"}})
+	p.config.CPUAffinity = []int{0, 2}
+
+	cmd, err := p.command(script{name: "s.sh", path: "s.sh"}, "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"taskset", "-c", "0,2", "/bin/sh", "s.sh", "image"}
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Fatalf("expected %v, got %v", want, cmd.Args)
+	}
+}
+
+func TestPostProcessorPostProcess_CPUAffinity(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cpu_affinity is only supported on linux")
+	}
+	if _, err := exec.LookPath("taskset"); err != nil {
+		t.Skip("taskset is not installed")
+	}
+	image := writeFile(t, t.TempDir(), "image", "")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":       []string{"grep Cpus_allowed_list /proc/self/status"},
+		"cpu_affinity": []int{0},
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "Cpus_allowed_list:\t0\n") {
+		t.Fatalf("expected the script to be pinned to CPU 0, got:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorConfigure_CPUAffinity(t *testing.T) {
+	p := new(PostProcessor)
+	err := p.Configure(map[string]interface{}{
+		"inline":       []string{"true"},
+		"cpu_affinity": []int{-1},
+	})
+	if err == nil || !strings.Contains(err.Error(), "cpu_affinity") {
+		t.Fatalf("expected a cpu_affinity error, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_ArtifactFileIndex(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		writeFile(t, dir, "a", ""),
+		writeFile(t, dir, "b", ""),
+		writeFile(t, dir, "c", ""),
+	}
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline": []string{`echo "file $PACKER_ARTIFACT_FILE_INDEX of $PACKER_ARTIFACT_FILE_COUNT: $1"`},
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(files...)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	for i, file := range files {
+		want := "file " + strconv.Itoa(i) + " of 3: " + file + "\n"
+		if !strings.Contains(ui.out.String(), want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, ui.out.String())
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_MaxArtifactSize(t *testing.T) {
+	dir := t.TempDir()
+	small := writeFile(t, dir, "small", "1234")
+	large := writeFile(t, dir, "large", "12345")
+	marker := filepath.Join(dir, "ran")
+
+	for _, tc := range []struct {
+		files []string
+		ok    bool
+	}{
+		{[]string{small}, true},
+		{[]string{small, large}, false},
+	} {
+		os.Remove(marker)
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":                  []string{"touch " + marker},
+			"max_artifact_size_bytes": 4,
+		})
+
+		_, _, err := p.PostProcess(new(testUi), testArtifact(tc.files...))
+		if tc.ok {
+			if err != nil {
+				t.Errorf("%v: PostProcess: %s", tc.files, err)
+			} else if _, err := os.Stat(marker); err != nil {
+				t.Errorf("%v: expected the scripts to run", tc.files)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), "larger than max_artifact_size_bytes") {
+			t.Errorf("%v: expected a size error, got %v", tc.files, err)
+		}
+		if _, err := os.Stat(marker); err == nil {
+			t.Errorf("%v: expected no scripts to run", tc.files)
+		}
+	}
+}
+
+func TestPostProcessorConfigure_MaxArtifactSize(t *testing.T) {
+	p := new(PostProcessor)
+	err := p.Configure(map[string]interface{}{
+		"inline":                  []string{"true"},
+		"max_artifact_size_bytes": -1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "max_artifact_size_bytes must not be negative") {
+		t.Fatalf("expected a max_artifact_size_bytes error, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_ResultFile(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{writeFile(t, dir, "a", ""), writeFile(t, dir, "b", "")}
+	ok := writeFile(t, dir, "ok.sh", "true")
+	fail := writeFile(t, dir, "fail.sh", `test "$1" != "`+files[1]+`" || exit 4`)
+	resultFile := filepath.Join(dir, "results.json")
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts":           []string{ok, fail},
+		"result_file":       resultFile,
+		"continue_on_error": true,
+	})
+
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(files...)); err == nil {
+		t.Fatal("expected the failure to be returned")
+	}
+
+	var results []ScriptResult
+	if err := json.Unmarshal([]byte(readFile(t, resultFile)), &results); err != nil {
+		t.Fatalf("expected result_file to be JSON: %s", err)
+	}
+	want := []ScriptResult{
+		{Script: ok, File: files[0], ExitCode: 0, Success: true},
+		{Script: fail, File: files[0], ExitCode: 0, Success: true},
+		{Script: ok, File: files[1], ExitCode: 0, Success: true},
+		{Script: fail, File: files[1], ExitCode: 4, Success: false},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %+v", len(want), results)
+	}
+	for i, result := range results {
+		if result.DurationSeconds <= 0 {
+			t.Errorf("result %d: expected a duration, got %f", i, result.DurationSeconds)
+		}
+		result.DurationSeconds = 0
+		if result != want[i] {
+			t.Errorf("result %d: expected %+v, got %+v", i, want[i], result)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_IdempotencyCheck(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	done := filepath.Join(dir, "done")
+	marker := filepath.Join(dir, "ran")
+
+	for _, tc := range []struct {
+		done bool
+		run  bool
+	}{
+		{false, true},
+		{true, false},
+	} {
+		os.Remove(marker)
+		if tc.done {
+			writeFile(t, dir, "done", "")
+		}
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":            []string{"touch " + marker},
+			"idempotency_check": `test -f "` + done + `" && test "$1" = "` + image + `"`,
+		})
+
+		in := testArtifact(image)
+		out, _, err := p.PostProcess(new(testUi), in)
+		if err != nil {
+			t.Fatalf("done %t: PostProcess: %s", tc.done, err)
+		}
+		if _, err := os.Stat(marker); (err == nil) != tc.run {
+			t.Errorf("done %t: expected scripts to run: %t", tc.done, tc.run)
+		}
+		if !tc.run && out != packer.Artifact(in) {
+			t.Errorf("done %t: expected the artifact to be returned unchanged, got %v", tc.done, out)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_IdempotencyCheckArchive(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	archive := filepath.Join(dir, "image.tar.gz")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":            []string{"true"},
+		"archive":           "tar.gz",
+		"archive_path":      archive,
+		"idempotency_check": `test "$1" = "` + image + `"`,
+	})
+
+	if _, _, err := p.PostProcess(new(testUi), testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Fatalf("expected no archive to be left behind when the check passes")
+	}
+}
+
+func TestPostProcessorPostProcess_MultipleProviders(t *testing.T) {
+	out := t.TempDir()
+	image := writeFile(t, t.TempDir(), "image", "contents")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{"true"},
+		"provider":         "aws, azure,gcp",
+		"output_structure": out + "/{{.Provider}}",
+	})
+
+	artifact, _, err := p.PostProcess(new(testUi), testArtifact(image))
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if got := artifact.Id(); got != "aws,azure,gcp" {
+		t.Errorf("expected ID aws,azure,gcp, got %s", got)
+	}
+	if got := artifact.String(); !strings.Contains(got, "for providers aws, azure, gcp") {
+		t.Errorf("expected String to name the providers, got %s", got)
+	}
+
+	want := map[string][]string{
+		"aws":   {filepath.Join(out, "aws", "image")},
+		"azure": {filepath.Join(out, "azure", "image")},
+		"gcp":   {filepath.Join(out, "gcp", "image")},
+	}
+	if got := artifact.State("provider_files"); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected provider_files %v, got %v", want, got)
+	}
+	if got := artifact.Files(); len(got) != 3 {
+		t.Errorf("expected a file for each provider, got %v", got)
+	}
+	for _, files := range want {
+		if got := readFile(t, files[0]); got != "contents" {
+			t.Errorf("expected %s to hold the artifact, got %q", files[0], got)
+		}
+	}
+}
+
+func TestPostProcessorConfigure_MultipleProviders(t *testing.T) {
+	for _, provider := range []string{"aws,", "aws,,gcp", "aws,gcp,aws"} {
+		p := new(PostProcessor)
+		err := p.Configure(map[string]interface{}{
+			"inline":   []string{"true"},
+			"provider": provider,
+		})
+		if err == nil || !strings.Contains(err.Error(), "provider must be a list") {
+			t.Errorf("%s: expected a provider error, got %v", provider, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_CaptureVars(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	create := writeFile(t, dir, "create.sh", `echo "created image-id: ami-1234"; echo "region us-east-1"`)
+	use := writeFile(t, dir, "use.sh", `echo "using $IMAGE_ID in $REGION"`)
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts": []string{create, use},
+		"capture_vars": map[string]string{
+			"IMAGE_ID": `image-id: (\S+)`,
+			"REGION":   `us-[a-z]+-\d`,
+		},
+	})
+
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "using ami-1234 in us-east-1\n") {
+		t.Fatalf("expected the captured values to be passed on, got:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorConfigure_CaptureVars(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pattern string
+	}{
+		{"BAD NAME", ".*"},
+		{"ID", "("},
+	} {
+		p := new(PostProcessor)
+		err := p.Configure(map[string]interface{}{
+			"inline":       []string{"true"},
+			"capture_vars": map[string]string{tc.name: tc.pattern},
+		})
+		if err == nil || !strings.Contains(err.Error(), "capture_vars") {
+			t.Errorf("%s: expected a capture_vars error, got %v", tc.name, err)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_Finalize(t *testing.T) {
+	for _, finalize := range []bool{true, false} {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		files := []string{
+			writeFile(t, dir, "a", "a"),
+			writeFile(t, dir, "b", "b"),
+			writeFile(t, dir, "c", "c"),
+		}
+		// b can't be placed over a directory that isn't empty, which
+		// fails the batch part of the way through.
+		writeFile(t, filepath.Join(out, "b"), "keep", "")
+
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":           []string{"true"},
+			"output_structure": out,
+			"finalize":         finalize,
+		})
+		if _, _, err := p.PostProcess(new(testUi), testArtifact(files...)); err == nil {
+			t.Fatalf("finalize %t: expected placing b to fail", finalize)
+		}
+
+		_, err := os.Stat(filepath.Join(out, "a"))
+		if placed := err == nil; placed == finalize {
+			t.Errorf("finalize %t: expected a to be placed: %t", finalize, !finalize)
+		}
+		if finalize {
+			for _, file := range files {
+				if _, err := os.Stat(file); err != nil {
+					t.Errorf("expected %s to be put back: %s", file, err)
+				}
+			}
+		}
+		if _, err := os.Stat(filepath.Join(out, "c")); err == nil {
+			t.Errorf("finalize %t: expected c not to be placed", finalize)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_FinalizeSuccess(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	files := []string{writeFile(t, dir, "a", "a"), writeFile(t, dir, "b", "b")}
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{"true"},
+		"output_structure": out,
+		"finalize":         true,
+	})
+
+	artifact, _, err := p.PostProcess(new(testUi), testArtifact(files...))
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	want := []string{filepath.Join(out, "a"), filepath.Join(out, "b")}
+	if !reflect.DeepEqual(artifact.Files(), want) {
+		t.Fatalf("expected files %v, got %v", want, artifact.Files())
+	}
+	for _, file := range files {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be moved", file)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_MaxOutputBytes(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	script := writeFile(t, dir, "chatty.sh", "head -c 1000000 /dev/zero | tr '\\0' x\nexit 3\n")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts":          []string{script},
+		"max_output_bytes": 1000,
+	})
+	ui := new(testUi)
+	_, _, err := p.PostProcess(ui, testArtifact(image))
+
+	scriptErr, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expected a ScriptError, got %#v", err)
+	}
+	if scriptErr.ExitCode != 3 {
+		t.Errorf("expected ExitCode 3, got %d", scriptErr.ExitCode)
+	}
+	if !strings.Contains(ui.out.String(), strings.Repeat("x", 1000)+"\n(output truncated)\n") {
+		t.Errorf("expected the output to be truncated, got %d bytes", ui.out.Len())
+	}
+	if strings.Contains(ui.out.String(), strings.Repeat("x", 1001)) {
+		t.Errorf("expected at most 1000 bytes of output, got %d bytes", ui.out.Len())
+	}
+}
+
+func TestPostProcessorConfigure_MaxOutputBytes(t *testing.T) {
+	p := testPostProcessor(t, map[string]interface{}{"inline": []string{"true"}})
+	if *p.config.MaxOutputBytes != defaultMaxOutputBytes {
+		t.Errorf("expected max_output_bytes to default to %d, got %d", defaultMaxOutputBytes, *p.config.MaxOutputBytes)
+	}
+
+	p = testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{"true"},
+		"max_output_bytes": 0,
+	})
+	if *p.config.MaxOutputBytes != 0 {
+		t.Errorf("expected max_output_bytes 0 to be kept, got %d", *p.config.MaxOutputBytes)
+	}
+
+	err := new(PostProcessor).Configure(map[string]interface{}{
+		"inline":           []string{"true"},
+		"max_output_bytes": -1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "max_output_bytes must not be negative") {
+		t.Errorf("expected a max_output_bytes error, got %v", err)
+	}
+}
+
+func TestPostProcessorConfigure_SkipMissingScripts(t *testing.T) {
+	dir := t.TempDir()
+	present := writeFile(t, dir, "present.sh", "echo present")
+	missing := filepath.Join(dir, "missing.sh")
+
+	err := new(PostProcessor).Configure(map[string]interface{}{
+		"scripts": []string{present, missing},
+	})
+	if err == nil || !strings.Contains(err.Error(), "Bad script '"+missing+"'") {
+		t.Fatalf("expected the missing script to fail Configure, got %v", err)
+	}
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"scripts":              []string{present, missing},
+		"skip_missing_scripts": true,
+	})
+	if !reflect.DeepEqual(p.config.Scripts, []string{present}) {
+		t.Errorf("expected only %s to be kept, got %v", present, p.config.Scripts)
+	}
+
+	image := writeFile(t, dir, "image", "")
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "Warning: Skipping script "+missing) {
+		t.Errorf("expected a warning about %s, got:\n%s", missing, ui.out.String())
+	}
+	if !strings.Contains(ui.out.String(), "present\n") {
+		t.Errorf("expected %s to run, got:\n%s", present, ui.out.String())
+	}
+
+	err = new(PostProcessor).Configure(map[string]interface{}{
+		"scripts":              []string{missing},
+		"skip_missing_scripts": true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "None of the scripts exist") {
+		t.Errorf("expected an error when no scripts exist, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_DestroyAuxFiles(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "contents")
+	archive := filepath.Join(dir, "image.tar.gz")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":           []string{"true"},
+		"archive":          "tar.gz",
+		"archive_path":     archive,
+		"compute_checksum": "sha256",
+		"checksum_sidecar": true,
+	})
+
+	artifact, _, err := p.PostProcess(new(testUi), testArtifact(image))
+	if err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	generated := []string{archive, archive + ".sha256"}
+	for _, file := range generated {
+		if _, err := os.Stat(file); err != nil {
+			t.Fatalf("expected %s to be generated: %s", file, err)
+		}
+	}
+
+	if err := artifact.Destroy(); err != nil {
+		t.Fatalf("Destroy: %s", err)
+	}
+	for _, file := range generated {
+		if _, err := os.Stat(file); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", file)
+		}
+	}
+	if _, err := os.Stat(image); err != nil {
+		t.Errorf("expected the input artifact to be kept: %s", err)
+	}
+}
+
+func TestPostProcessorPostProcess_DestroyCopies(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		raw  func(out string) map[string]interface{}
+	}{
+		{"copy mode", func(out string) map[string]interface{} {
+			return map[string]interface{}{"mode": "copy", "target": out + "/{{.Provider}}"}
+		}},
+		{"multiple providers", func(out string) map[string]interface{} {
+			return map[string]interface{}{
+				"inline":           []string{"true"},
+				"provider":         "aws,gcp",
+				"output_structure": out + "/{{.Provider}}",
+			}
+		}},
+	} {
+		out := t.TempDir()
+		image := writeFile(t, t.TempDir(), "image", "contents")
+		p := testPostProcessor(t, tc.raw(out))
+
+		in := testArtifact(image)
+		in.state["provider"] = "aws"
+		artifact, _, err := p.PostProcess(new(testUi), in)
+		if err != nil {
+			t.Fatalf("%s: PostProcess: %s", tc.name, err)
+		}
+		copied := filepath.Join(out, "aws", "image")
+		if got := readFile(t, copied); got != "contents" {
+			t.Fatalf("%s: expected %s to be a copy, got %q", tc.name, copied, got)
+		}
+
+		if err := artifact.Destroy(); err != nil {
+			t.Fatalf("%s: Destroy: %s", tc.name, err)
+		}
+		if _, err := os.Stat(copied); !os.IsNotExist(err) {
+			t.Errorf("%s: expected %s to be removed", tc.name, copied)
+		}
+	}
+}
+
+func TestPostProcessorPostProcess_UserVariablesInEnv(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline":                []string{`echo "region=$REGION zone=$ZONE"`},
+		"environment_vars":      []string{`REGION={{user "region"}}`, `ZONE={{user "region"}}-{{user "zone"}}`},
+		"packer_user_variables": map[string]string{"region": "us-east-1", "zone": "a"},
+	})
+
+	if !reflect.DeepEqual(p.config.Vars, []string{"REGION=us-east-1", "ZONE=us-east-1-a"}) {
+		t.Errorf("expected environment_vars to be interpolated, got %v", p.config.Vars)
+	}
+	ui := new(testUi)
+	if _, _, err := p.PostProcess(ui, testArtifact(image)); err != nil {
+		t.Fatalf("PostProcess: %s", err)
+	}
+	if !strings.Contains(ui.out.String(), "region=us-east-1 zone=us-east-1-a\n") {
+		t.Fatalf("expected the user variables to reach the script, got:\n%s", ui.out.String())
+	}
+}
+
+func TestPostProcessorPostProcess_RunOnFinalOnly(t *testing.T) {
+	image := writeFile(t, t.TempDir(), "image", "")
+
+	for _, tc := range []struct {
+		builderId string
+		final     interface{}
+		runs      bool
+	}{
+		{"packer.post-processor.compress", nil, true},
+		{"mitchellh.amazonebs", nil, false},
+		{"mitchellh.amazonebs", true, true},
+		{"packer.post-processor.compress", false, false},
+	} {
+		p := testPostProcessor(t, map[string]interface{}{
+			"inline":            []string{"echo script-ran"},
+			"run_on_final_only": true,
+			"final_builder_ids": []string{"packer.post-processor.compress"},
+		})
+
+		in := testArtifact(image)
+		in.builderId = tc.builderId
+		if tc.final != nil {
+			in.state[finalArtifactState] = tc.final
+		}
+		ui := new(testUi)
+		out, _, err := p.PostProcess(ui, in)
+		if err != nil {
+			t.Fatalf("%s, final %v: PostProcess: %s", tc.builderId, tc.final, err)
+		}
+		if ran := strings.Contains(ui.out.String(), "script-ran"); ran != tc.runs {
+			t.Errorf("%s, final %v: expected the scripts to run: %t", tc.builderId, tc.final, tc.runs)
+		}
+		if !tc.runs && out != packer.Artifact(in) {
+			t.Errorf("%s, final %v: expected the artifact to be returned unchanged", tc.builderId, tc.final)
+		}
+	}
+
+	err := new(PostProcessor).Configure(map[string]interface{}{
+		"inline":            []string{"true"},
+		"run_on_final_only": true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "run_on_final_only requires final_builder_ids") {
+		t.Fatalf("expected an error without final_builder_ids, got %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// interruptGracePeriod is how long a script's process group is given to
+// exit after SIGTERM before it is killed.
+const interruptGracePeriod = 10 * time.Second
+
+// InterruptError is returned when a script is stopped because the plugin
+// received an interrupt signal.
+type InterruptError struct {
+	Signal os.Signal
+}
+
+func (e *InterruptError) Error() string {
+	return fmt.Sprintf("Interrupted by signal %s", e.Signal)
+}
+
+// runInterruptible runs cmd in its own process group, stopping the whole
+// group if a signal arrives on interrupt before it exits.
+func runInterruptible(cmd *exec.Cmd, interrupt <-chan os.Signal) error {
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case sig := <-interrupt:
+		terminateProcessGroup(cmd.Process, syscallTerm)
+		select {
+		case <-done:
+		case <-time.After(interruptGracePeriod):
+			terminateProcessGroup(cmd.Process, os.Kill)
+			<-done
+		}
+		return &InterruptError{Signal: sig}
+	}
+}
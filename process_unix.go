@@ -0,0 +1,31 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var syscallTerm os.Signal = syscall.SIGTERM
+
+// setProcessGroup starts cmd in a new process group so that it and any
+// children it spawns can be signalled together.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// terminateProcessGroup sends sig to every process in the group led by
+// process.
+func terminateProcessGroup(process *os.Process, sig os.Signal) {
+	if process == nil {
+		return
+	}
+	if err := syscall.Kill(-process.Pid, sig.(syscall.Signal)); err != nil {
+		process.Signal(sig)
+	}
+}
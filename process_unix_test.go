@@ -0,0 +1,154 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// waitForFile waits up to timeout for path to exist, and returns whether
+// it does.
+func waitForFile(path string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRunInterruptible_Interrupt(t *testing.T) {
+	started := filepath.Join(t.TempDir(), "started")
+	cmd := exec.Command("/bin/sh", "-c", "sleep 30 & touch "+started+"; sleep 30")
+
+	interrupt := make(chan os.Signal, 1)
+	go func() {
+		if waitForFile(started, 10*time.Second) {
+			interrupt <- os.Interrupt
+		}
+	}()
+
+	start := time.Now()
+	err := runInterruptible(cmd, interrupt)
+	interruptErr, ok := err.(*InterruptError)
+	if !ok {
+		t.Fatalf("expected an InterruptError, got %#v", err)
+	}
+	if interruptErr.Signal != os.Interrupt {
+		t.Fatalf("expected the interrupt signal, got %s", interruptErr.Signal)
+	}
+	if elapsed := time.Since(start); elapsed > interruptGracePeriod {
+		t.Fatalf("expected the script to stop on SIGTERM, took %s", elapsed)
+	}
+}
+
+func TestRunInterruptible_Exit(t *testing.T) {
+	err := runInterruptible(exec.Command("/bin/sh", "-c", "exit 2"), make(chan os.Signal))
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || exitErr.ExitCode() != 2 {
+		t.Fatalf("expected exit code 2, got %v", err)
+	}
+}
+
+func TestPostProcessorPostProcess_Interrupt(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	started := filepath.Join(dir, "started")
+
+	p := testPostProcessor(t, map[string]interface{}{
+		"inline_scripts": map[string]string{
+			"1.sh": "touch " + started + "; sleep 30",
+			"2.sh": "echo second",
+		},
+	})
+
+	go func() {
+		if waitForFile(started, 10*time.Second) {
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+		}
+	}()
+
+	ui := new(testUi)
+	start := time.Now()
+	_, _, err := p.PostProcess(ui, testArtifact(image))
+	if _, ok := err.(*InterruptError); !ok {
+		t.Fatalf("expected an InterruptError, got %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed > interruptGracePeriod {
+		t.Fatalf("expected the script to be stopped right away, took %s", elapsed)
+	}
+	if strings.Contains(ui.out.String(), "second") {
+		t.Fatal("expected the remaining scripts not to run")
+	}
+}
+
+func TestExitSignal(t *testing.T) {
+	if got := exitSignal(exec.Command("/bin/sh", "-c", "exit 2").Run()); got != "" {
+		t.Errorf("expected no signal for a normal exit, got %q", got)
+	}
+	err := exec.Command("/bin/sh", "-c", "kill -SEGV $$").Run()
+	if got, want := exitSignal(err), syscall.SIGSEGV.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestPostProcessorPostProcess_ScriptSignal(t *testing.T) {
+	dir := t.TempDir()
+	image := writeFile(t, dir, "image", "")
+	script := writeFile(t, dir, "crash.sh", "kill -SEGV $$\n")
+
+	p := testPostProcessor(t, map[string]interface{}{"scripts": []string{script}})
+	_, _, err := p.PostProcess(new(testUi), testArtifact(image))
+
+	scriptErr, ok := err.(*ScriptError)
+	if !ok {
+		t.Fatalf("expected a ScriptError, got %#v", err)
+	}
+	if scriptErr.Signal != syscall.SIGSEGV.String() {
+		t.Errorf("expected Signal %q, got %q", syscall.SIGSEGV.String(), scriptErr.Signal)
+	}
+	if scriptErr.ExitCode != -1 {
+		t.Errorf("expected ExitCode -1, got %d", scriptErr.ExitCode)
+	}
+	if !strings.Contains(err.Error(), "killed by signal: "+syscall.SIGSEGV.String()) {
+		t.Errorf("expected the error to name the signal, got %s", err)
+	}
+}
+
+func TestPostProcessor_ShareWithRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only root can give files away")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("there is no nobody user")
+	}
+	p := testPostProcessor(t, map[string]interface{}{"inline": []string{"true"}})
+	p.config.RunAs = "nobody"
+
+	dir := t.TempDir()
+	if err := p.shareWithRunAs(dir, 0770); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if strconv.Itoa(int(stat.Uid)) != u.Uid || strconv.Itoa(int(stat.Gid)) != u.Gid {
+		t.Errorf("expected %s to be owned by %s:%s, got %d:%d", dir, u.Uid, u.Gid, stat.Uid, stat.Gid)
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		t.Errorf("expected %s not to be writable by others, got %s", dir, info.Mode())
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Windows has no SIGTERM to deliver, so the process is killed outright.
+var syscallTerm os.Signal = os.Kill
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessGroup kills process. Windows cannot signal a process
+// group, so any children it spawned are left running.
+func terminateProcessGroup(process *os.Process, sig os.Signal) {
+	if process != nil {
+		process.Kill()
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// sleep waits for the pauses between scripts and retries. Tests replace
+// it to check the delays without waiting for them.
+var sleep = time.Sleep
+
+// retryBackoffs are the valid values of retry_backoff.
+var retryBackoffs = []string{"fixed", "exponential"}
+
+// backoffDelay returns how long to wait before retry number attempt,
+// counting from zero. With "exponential" backoff, delay is doubled for
+// each earlier attempt. The result is capped at maxDelay unless it is 0.
+func backoffDelay(backoff string, delay, maxDelay time.Duration, attempt int) time.Duration {
+	if backoff == "exponential" {
+		for i := 0; i < attempt && (maxDelay == 0 || delay < maxDelay); i++ {
+			if delay > math.MaxInt64/2 {
+				break
+			}
+			delay *= 2
+		}
+	}
+	if maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
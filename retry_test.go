@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for _, tc := range []struct {
+		backoff  string
+		delay    time.Duration
+		maxDelay time.Duration
+		attempt  int
+		want     time.Duration
+	}{
+		{"fixed", time.Second, 0, 0, time.Second},
+		{"fixed", time.Second, 0, 5, time.Second},
+		{"fixed", 10 * time.Second, 3 * time.Second, 0, 3 * time.Second},
+		{"exponential", time.Second, 0, 0, time.Second},
+		{"exponential", time.Second, 0, 1, 2 * time.Second},
+		{"exponential", time.Second, 0, 2, 4 * time.Second},
+		{"exponential", time.Second, 0, 5, 32 * time.Second},
+		{"exponential", time.Second, 10 * time.Second, 3, 8 * time.Second},
+		{"exponential", time.Second, 10 * time.Second, 4, 10 * time.Second},
+		{"exponential", time.Second, 10 * time.Second, 1000, 10 * time.Second},
+	} {
+		if got := backoffDelay(tc.backoff, tc.delay, tc.maxDelay, tc.attempt); got != tc.want {
+			t.Errorf("%s from %s, max %s, attempt %d: expected %s, got %s",
+				tc.backoff, tc.delay, tc.maxDelay, tc.attempt, tc.want, got)
+		}
+	}
+
+	// Without a cap, doubling stops short of overflowing.
+	if got := backoffDelay("exponential", time.Hour, 0, 1000); got < time.Hour {
+		t.Errorf("expected a delay of at least an hour without overflowing, got %s", got)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sequenceLockTimeout is how long nextSequence waits for another process
+// to release the sequence file.
+const sequenceLockTimeout = 30 * time.Second
+
+// staleSequenceLockAge is the age past which a lock is taken to have been
+// left behind by a run that was killed. The lock is only held for as long
+// as it takes to update the counter.
+const staleSequenceLockAge = 10 * time.Second
+
+// dryRunSequence is the PACKER_RUN_SEQ of runs that don't run the scripts,
+// which leave the counter as it is.
+const dryRunSequence = "0"
+
+// nextSequence increments the counter stored in path, which is created
+// when missing, and returns its new value. A lock file next to it keeps
+// concurrent runs from reading the same value, and the new value is
+// written to a temporary file renamed into place, so the counter is
+// never left half written. A lock left behind by a killed run is removed
+// once it is stale.
+func nextSequence(path string) (int, error) {
+	lock := path + ".lock"
+	deadline := time.Now().Add(sequenceLockTimeout)
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return 0, err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > staleSequenceLockAge {
+			log.Printf("Removing stale sequence_file lock: %s", lock)
+			os.Remove(lock)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("timed out waiting for lock %s; if no other build is using it, delete it", lock)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	defer os.Remove(lock)
+
+	seq := 0
+	contents, err := ioutil.ReadFile(path)
+	if err == nil {
+		seq, err = strconv.Atoi(strings.TrimSpace(string(contents)))
+		if err != nil {
+			return 0, fmt.Errorf("bad sequence in %s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	seq++
+
+	tf, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tf.WriteString(strconv.Itoa(seq) + "\n"); err != nil {
+		tf.Close()
+		os.Remove(tf.Name())
+		return 0, err
+	}
+	if err := tf.Close(); err != nil {
+		os.Remove(tf.Name())
+		return 0, err
+	}
+	if err := os.Rename(tf.Name(), path); err != nil {
+		os.Remove(tf.Name())
+		return 0, err
+	}
+
+	return seq, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextSequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seq")
+	for want := 1; want <= 3; want++ {
+		seq, err := nextSequence(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq != want {
+			t.Fatalf("expected %d, got %d", want, seq)
+		}
+	}
+	if contents := readFile(t, path); contents != "3\n" {
+		t.Fatalf("expected the file to hold 3, got %q", contents)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Fatal("expected the lock file to be removed")
+	}
+}
+
+func TestNextSequence_Concurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seq")
+
+	const runs = 10
+	seqs := make([]int, runs)
+	var wg sync.WaitGroup
+	for i := range seqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			seq, err := nextSequence(path)
+			if err != nil {
+				t.Error(err)
+			}
+			seqs[i] = seq
+		}(i)
+	}
+	wg.Wait()
+
+	sort.Ints(seqs)
+	for i, seq := range seqs {
+		if seq != i+1 {
+			t.Fatalf("expected each run to get its own number, got %v", seqs)
+		}
+	}
+}
+
+func TestNextSequence_Bad(t *testing.T) {
+	path := writeFile(t, t.TempDir(), "seq", "not a number\n")
+	if _, err := nextSequence(path); err == nil {
+		t.Fatal("expected an error for a bad sequence")
+	}
+}
+
+func TestNextSequence_StaleLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seq")
+	lock := writeFile(t, filepath.Dir(path), "seq.lock", "")
+	old := time.Now().Add(-staleSequenceLockAge - time.Second)
+	if err := os.Chtimes(lock, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	seq, err := nextSequence(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 1 {
+		t.Fatalf("expected 1, got %d", seq)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the stale lock to be removed right away, took %s", elapsed)
+	}
+}